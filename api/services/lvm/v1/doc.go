@@ -0,0 +1,27 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package lvm defines version 1 of the gRPC service exposing the operations
+// of the LVM snapshotter that containerd's snapshots API has no room for. It
+// is served on the same socket as the snapshots API. Changes to version 1 only
+// add fields and methods, anything else goes into a new version.
+//
+// The service is defined in lvm.proto, lvm.pb.go is generated from it with
+// protobuild.
+package lvm
+
+// ServiceName is the fully qualified name of the service
+const ServiceName = "containerd.snapshotter.lvm.v1.LVM"
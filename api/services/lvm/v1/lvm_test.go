@@ -0,0 +1,166 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/types"
+	"github.com/containerd/containerd/errdefs"
+	"google.golang.org/grpc"
+	"gotest.tools/assert"
+)
+
+type fakeServer struct {
+	requests []CloneRequest
+}
+
+func (f *fakeServer) Info(ctx context.Context, r *InfoRequest) (*InfoResponse, error) {
+	if r.Key != "active" {
+		return nil, errdefs.ToGRPC(errdefs.ErrNotFound)
+	}
+	return &InfoResponse{Device: DeviceInfo{VgName: "vg", LVName: "1", Major: 253, Minor: 1, Active: true}}, nil
+}
+
+func (f *fakeServer) PoolStatus(ctx context.Context, r *PoolStatusRequest) (*PoolStatusResponse, error) {
+	return &PoolStatusResponse{Pools: []Pool{{Name: "default", DataPercent: 12.5}}}, nil
+}
+
+func (f *fakeServer) Resize(ctx context.Context, r *ResizeRequest) (*ResizeResponse, error) {
+	return nil, errdefs.ToGRPC(errdefs.ErrInvalidArgument)
+}
+
+func (f *fakeServer) Clone(ctx context.Context, r *CloneRequest) (*CloneResponse, error) {
+	f.requests = append(f.requests, *r)
+	return &CloneResponse{Mounts: []*types.Mount{{Type: "xfs", Source: "/dev/vg/" + r.Key}}}, nil
+}
+
+func (f *fakeServer) Reset(ctx context.Context, r *ResetRequest) (*ResetResponse, error) {
+	return &ResetResponse{}, nil
+}
+
+func (f *fakeServer) Reconcile(ctx context.Context, r *ReconcileRequest) (*ReconcileResponse, error) {
+	return &ReconcileResponse{OrphanVolumes: []string{"vg/2"}, Removed: r.Remove}, nil
+}
+
+func (f *fakeServer) Subscribe(r *SubscribeRequest, stream LVM_SubscribeServer) error {
+	if len(r.Namespaces) == 0 {
+		return errdefs.ToGRPC(errdefs.ErrInvalidArgument)
+	}
+	for _, ns := range r.Namespaces {
+		if err := stream.Send(&Event{Type: "created", Namespace: ns, Name: "active", Timestamp: time.Unix(1, 0).UTC()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTestClient serves srv on a unix socket and returns a connected client
+func newTestClient(t *testing.T, srv LVMServer) LVMClient {
+	dir, err := ioutil.TempDir("", "lvm-api-")
+	assert.NilError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	addr := filepath.Join(dir, "lvm.sock")
+	l, err := net.Listen("unix", addr)
+	assert.NilError(t, err)
+
+	rpc := grpc.NewServer()
+	RegisterLVMServer(rpc, srv)
+	go rpc.Serve(l)
+	t.Cleanup(rpc.Stop)
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+	}))
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return NewLVMClient(conn)
+}
+
+func TestClone(t *testing.T) {
+	srv := &fakeServer{}
+	client := newTestClient(t, srv)
+
+	resp, err := client.Clone(context.Background(), &CloneRequest{
+		Key:    "clone",
+		Source: "active",
+		Labels: map[string]string{"foo": "bar"},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, resp.Mounts, []*types.Mount{{Type: "xfs", Source: "/dev/vg/clone"}})
+	assert.Equal(t, len(srv.requests), 1)
+	assert.DeepEqual(t, srv.requests[0], CloneRequest{Key: "clone", Source: "active", Labels: map[string]string{"foo": "bar"}})
+}
+
+func TestInfo(t *testing.T) {
+	client := newTestClient(t, &fakeServer{})
+
+	resp, err := client.Info(context.Background(), &InfoRequest{Key: "active"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, resp.Device, DeviceInfo{VgName: "vg", LVName: "1", Major: 253, Minor: 1, Active: true})
+
+	_, err = client.Info(context.Background(), &InfoRequest{Key: "missing"})
+	assert.Assert(t, errdefs.IsNotFound(errdefs.FromGRPC(err)))
+}
+
+func TestPoolStatusAndReconcile(t *testing.T) {
+	client := newTestClient(t, &fakeServer{})
+
+	status, err := client.PoolStatus(context.Background(), &PoolStatusRequest{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, status.Pools, []Pool{{Name: "default", DataPercent: 12.5}})
+
+	report, err := client.Reconcile(context.Background(), &ReconcileRequest{Remove: true})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *report, ReconcileResponse{OrphanVolumes: []string{"vg/2"}, Removed: true})
+
+	_, err = client.Resize(context.Background(), &ResizeRequest{Key: "active", SizeBytes: 1})
+	assert.Assert(t, errdefs.IsInvalidArgument(errdefs.FromGRPC(err)))
+}
+
+func TestSubscribe(t *testing.T) {
+	client := newTestClient(t, &fakeServer{})
+
+	stream, err := client.Subscribe(context.Background(), &SubscribeRequest{Namespaces: []string{"default", "k8s.io"}})
+	assert.NilError(t, err)
+	var events []Event
+	for {
+		ev, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		events = append(events, *ev)
+	}
+	assert.DeepEqual(t, events, []Event{
+		{Type: "created", Namespace: "default", Name: "active", Timestamp: time.Unix(1, 0).UTC()},
+		{Type: "created", Namespace: "k8s.io", Name: "active", Timestamp: time.Unix(1, 0).UTC()},
+	})
+
+	stream, err = client.Subscribe(context.Background(), &SubscribeRequest{})
+	assert.NilError(t, err)
+	_, err = stream.Recv()
+	assert.Assert(t, errdefs.IsInvalidArgument(errdefs.FromGRPC(err)))
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+// The administration commands open the metadata and volumes of a stopped
+// snapshotter with the same code the daemon uses. They take the same
+// configuration as the daemon, init creates the pool it names.
+var adminCommands = []cli.Command{
+	{
+		Name:  "init",
+		Usage: "create the volume group and thin pool, leaving existing ones alone",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "device",
+				Usage: "block device of the volume group, can be repeated",
+			},
+			cli.StringFlag{
+				Name:  "loop-file",
+				Usage: "sparse file backing the volume group through a loop device, instead of --device",
+			},
+			cli.StringFlag{
+				Name:  "loop-size",
+				Usage: "size of the loop file",
+			},
+			cli.StringFlag{
+				Name:  "data-size",
+				Usage: "size of the thin pool, or a share of the volume group like 90%FREE (default: 90%FREE)",
+			},
+			cli.StringFlag{
+				Name:  "metadata-size",
+				Usage: "size of the thin pool metadata (default: chosen by LVM)",
+			},
+			cli.StringFlag{
+				Name:  "chunk-size",
+				Usage: "chunk size of the thin pool (default: chosen by LVM)",
+			},
+			cli.BoolFlag{
+				Name:  "zero",
+				Usage: "zero the first block of newly provisioned chunks",
+			},
+			cli.StringFlag{
+				Name:  "discards",
+				Usage: "discard mode of the thin pool: ignore, nopassdown or passdown (default: chosen by LVM)",
+			},
+		},
+		Action: initPool,
+	},
+	{
+		Name:   "ls",
+		Usage:  "list snapshots with their kind, parent, logical volume and size",
+		Action: listSnapshots,
+	},
+	{
+		Name:      "inspect",
+		Usage:     "show the snapshot and device details of a snapshot",
+		ArgsUsage: "<key>",
+		Action:    inspectSnapshot,
+	},
+	{
+		Name:      "mount",
+		Usage:     "mount a snapshot read-only for debugging",
+		ArgsUsage: "<key> <dir>",
+		Action:    mountSnapshot,
+	},
+	{
+		Name:   "gc",
+		Usage:  "delete logical volumes and volume records that belong to no snapshot",
+		Action: collectGarbage,
+	},
+	{
+		Name:   "fsck",
+		Usage:  "check the metadata against the logical volumes of the pools",
+		Action: checkConsistency,
+	},
+	{
+		Name:  "pool",
+		Usage: "manage thin pools",
+		Subcommands: []cli.Command{
+			{
+				Name:   "status",
+				Usage:  "show the usage and health of the thin pools",
+				Action: showPoolStatus,
+			},
+		},
+	},
+	{
+		Name:   "teardown",
+		Usage:  "unmount and deactivate the volumes of all snapshots",
+		Action: teardown,
+	},
+}
+
+// checkStopped makes sure no daemon serves the socket, as the metadata can
+// only be opened by a single process
+func checkStopped(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", addr, time.Second)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	return errors.Errorf("lvm-snapshotter is running on %s, stop it first", addr)
+}
+
+// withSnapshotter opens the snapshotter described by the global flags for the
+// duration of fn
+func withSnapshotter(c *cli.Context, fn func(context.Context, lvms.Snapshotter) error) error {
+	config, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	config.setupLogging()
+	if err := checkStopped(config.Address); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	sn, err := lvms.NewSnapshotter(ctx, &config.Snapshotter)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := sn.Close(); closeErr != nil {
+			fmt.Printf("error: %v\n", closeErr)
+		}
+	}()
+	return fn(ctx, sn)
+}
+
+func listSnapshots(c *cli.Context) error {
+	return withSnapshotter(c, func(ctx context.Context, sn lvms.Snapshotter) error {
+		tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tKIND\tPARENT\tLV\tSIZE")
+		if err := sn.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+			lv, size := "-", "-"
+			if dev, err := sn.DeviceInfo(ctx, info.Name); err == nil {
+				lv, size = dev.VgName+"/"+dev.LVName, units.HumanSize(float64(dev.Size))
+			} else {
+				lv = "error: " + err.Error()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", info.Name, info.Kind, info.Parent, lv, size)
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tw.Flush()
+	})
+}
+
+func inspectSnapshot(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("inspect takes the key of a snapshot")
+	}
+	key := c.Args().First()
+	return withSnapshotter(c, func(ctx context.Context, sn lvms.Snapshotter) error {
+		info, err := sn.Stat(ctx, key)
+		if err != nil {
+			return err
+		}
+		usage, err := sn.Usage(ctx, key)
+		if err != nil {
+			return err
+		}
+		dev, err := sn.DeviceInfo(ctx, key)
+		if err != nil {
+			return err
+		}
+		out, err := json.MarshalIndent(struct {
+			Info   snapshots.Info
+			Usage  snapshots.Usage
+			Device lvms.DeviceInfo
+		}{info, usage, dev}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	})
+}
+
+func mountSnapshot(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.New("mount takes the key of a snapshot and a directory")
+	}
+	key, dir := c.Args().Get(0), c.Args().Get(1)
+	return withSnapshotter(c, func(ctx context.Context, sn lvms.Snapshotter) error {
+		mounts, err := sn.InspectMounts(ctx, key)
+		if err != nil {
+			return err
+		}
+		if err := mount.All(mounts, dir); err != nil {
+			return errors.Wrapf(err, "Unable to mount %s on %s", key, dir)
+		}
+		fmt.Printf("Mounted %s read-only on %s, unmount it and run teardown when done\n", key, dir)
+		return nil
+	})
+}
+
+func printReport(report lvms.ReconcileReport) {
+	for _, v := range report.OrphanVolumes {
+		fmt.Printf("orphan volume: %s\n", v)
+	}
+	for _, k := range report.MissingVolumes {
+		fmt.Printf("missing volume: %s\n", k)
+	}
+	for _, id := range report.StaleRecords {
+		fmt.Printf("stale record: %s\n", id)
+	}
+}
+
+func collectGarbage(c *cli.Context) error {
+	return withSnapshotter(c, func(ctx context.Context, sn lvms.Snapshotter) error {
+		report, err := sn.Reconcile(ctx, true)
+		if err != nil {
+			return err
+		}
+		printReport(report)
+		fmt.Printf("Removed %d volumes and %d records\n", len(report.OrphanVolumes), len(report.StaleRecords))
+		if len(report.MissingVolumes) > 0 {
+			fmt.Println("Snapshots with missing volumes have to be removed through containerd")
+		}
+		return nil
+	})
+}
+
+func checkConsistency(c *cli.Context) error {
+	return withSnapshotter(c, func(ctx context.Context, sn lvms.Snapshotter) error {
+		report, err := sn.Reconcile(ctx, false)
+		if err != nil {
+			return err
+		}
+		printReport(report)
+		if len(report.OrphanVolumes)+len(report.MissingVolumes)+len(report.StaleRecords) > 0 {
+			return cli.NewExitError("inconsistencies found", 1)
+		}
+		fmt.Println("No inconsistencies found")
+		return nil
+	})
+}
+
+func showPoolStatus(c *cli.Context) error {
+	return withSnapshotter(c, func(ctx context.Context, sn lvms.Snapshotter) error {
+		status, err := sn.PoolStatus(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tPOOL\tTIER\tSIZE\tDATA%\tMETA%\tHEALTH")
+		for _, p := range status {
+			health := p.Health
+			if p.Error != "" {
+				health = "error: " + p.Error
+			} else if health == "" {
+				health = "ok"
+			}
+			fmt.Fprintf(tw, "%s\t%s/%s\t%s\t%s\t%.2f\t%.2f\t%s\n", p.Name, p.VgName, p.ThinPool, p.Tier, units.HumanSize(float64(p.Size)), p.DataPercent, p.MetadataPercent, health)
+		}
+		return tw.Flush()
+	})
+}
+
+func teardown(c *cli.Context) error {
+	return withSnapshotter(c, func(ctx context.Context, sn lvms.Snapshotter) error {
+		return sn.Teardown(ctx)
+	})
+}
+
+func initPool(c *cli.Context) error {
+	config, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	config.setupLogging()
+	p := lvms.ProvisionConfig{
+		VgName:   config.Snapshotter.VgName,
+		ThinPool: config.Snapshotter.ThinPool,
+		Devices:  c.StringSlice("device"),
+		LoopFile: c.String("loop-file"),
+		LoopSize: c.String("loop-size"),
+		Pool: lvms.ThinPoolOptions{
+			DataSize:     c.String("data-size"),
+			MetadataSize: c.String("metadata-size"),
+			ChunkSize:    c.String("chunk-size"),
+			Zero:         c.Bool("zero"),
+			Discards:     c.String("discards"),
+		},
+	}
+	if err := p.Validate(); err != nil {
+		return errors.Wrap(err, "Failed to validate init options")
+	}
+	if err := lvms.Provision(context.Background(), p); err != nil {
+		return err
+	}
+	fmt.Printf(`Thin pool %s/%s is ready. Configure containerd with:
+
+[plugins]
+  [plugins.lvm]
+    vol_group = %q
+    thin_pool = %q
+
+or run the snapshotter with:
+
+lvm-snapshotter --addr <socket> --vgname %s --lvpoolname %s
+`, p.VgName, p.ThinPool, p.VgName, p.ThinPool, p.VgName, p.ThinPool)
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+const defaultSocketMode = "0660"
+
+// daemonSettings are the settings of the standalone daemon that have no
+// meaning for the containerd plugin
+type daemonSettings struct {
+	// Address is the unix socket the daemon listens on
+	Address string `toml:"address"`
+
+	// SocketMode and SocketGroup are the permissions and group of the socket
+	SocketMode  string `toml:"socket_mode"`
+	SocketGroup string `toml:"socket_group"`
+
+	// LogLevel and LogFormat configure the logs, which go to standard error
+	LogLevel  string `toml:"log_level"`
+	LogFormat string `toml:"log_format"`
+
+	// MetricsAddress is the TCP address Prometheus metrics are served on
+	MetricsAddress string `toml:"metrics_address"`
+
+	// HealthInterval is the time between two probes of the pools and the
+	// metadata volume
+	HealthInterval string `toml:"health_interval"`
+
+	Tracing tracingSettings `toml:"tracing"`
+}
+
+// daemonConfig is the configuration of the standalone daemon. Its file holds
+// the daemon settings next to the snapshotter settings, which use the same
+// keys as the [plugins.lvm] section of containerd's configuration.
+type daemonConfig struct {
+	daemonSettings
+	Snapshotter lvms.SnapConfig
+}
+
+// configFlags are the global flags overriding the configuration file. Each
+// can also be set through its environment variable.
+var configFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "config",
+		Usage:  "path to the TOML configuration file",
+		EnvVar: "LVM_SNAPSHOTTER_CONFIG",
+	},
+	cli.StringFlag{
+		Name:   "addr",
+		Usage:  "the socket the snapshotter will listen on, it is the 'address' in the containerd 'proxy plugin' configuration.",
+		EnvVar: "LVM_SNAPSHOTTER_ADDR",
+	},
+	cli.StringFlag{
+		Name:   "vgname",
+		Usage:  "name of created volume group",
+		EnvVar: "LVM_SNAPSHOTTER_VGNAME",
+	},
+	cli.StringFlag{
+		Name:   "lvpoolname",
+		Usage:  "name of logical volume pool",
+		EnvVar: "LVM_SNAPSHOTTER_LVPOOLNAME",
+	},
+	cli.StringFlag{
+		Name:   "root-path",
+		Usage:  "directory the metadata volume is mounted under",
+		EnvVar: "LVM_SNAPSHOTTER_ROOT_PATH",
+	},
+	cli.StringFlag{
+		Name:   "img-size",
+		Usage:  "size of the thin volumes",
+		EnvVar: "LVM_SNAPSHOTTER_IMG_SIZE",
+	},
+	cli.StringFlag{
+		Name:   "fs-type",
+		Usage:  "filesystem the volumes are formatted with",
+		EnvVar: "LVM_SNAPSHOTTER_FS_TYPE",
+	},
+	cli.StringFlag{
+		Name:   "socket-mode",
+		Usage:  "permissions of the socket, in octal (default: " + defaultSocketMode + ")",
+		EnvVar: "LVM_SNAPSHOTTER_SOCKET_MODE",
+	},
+	cli.StringFlag{
+		Name:   "socket-group",
+		Usage:  "group owning the socket, by name or ID",
+		EnvVar: "LVM_SNAPSHOTTER_SOCKET_GROUP",
+	},
+	cli.StringFlag{
+		Name:   "log-level",
+		Usage:  "log level: trace, debug, info, warn, error, fatal or panic (default: info)",
+		EnvVar: "LVM_SNAPSHOTTER_LOG_LEVEL",
+	},
+	cli.StringFlag{
+		Name:   "log-format",
+		Usage:  "log format: text or json (default: text)",
+		EnvVar: "LVM_SNAPSHOTTER_LOG_FORMAT",
+	},
+	cli.StringFlag{
+		Name:   "metrics-addr",
+		Usage:  "TCP address to serve Prometheus metrics on, like 127.0.0.1:9523 (default: disabled)",
+		EnvVar: "LVM_SNAPSHOTTER_METRICS_ADDR",
+	},
+	cli.StringFlag{
+		Name:   "health-interval",
+		Usage:  "time between two health probes (default: " + defaultHealthInterval + ")",
+		EnvVar: "LVM_SNAPSHOTTER_HEALTH_INTERVAL",
+	},
+	cli.StringFlag{
+		Name:   "trace-exporter",
+		Usage:  "where to export traces: otlp or file (default: disabled)",
+		EnvVar: "LVM_SNAPSHOTTER_TRACE_EXPORTER",
+	},
+	cli.StringFlag{
+		Name:   "trace-endpoint",
+		Usage:  "OTLP/HTTP URL the otlp exporter posts traces to (default: " + defaultTraceEndpoint + ")",
+		EnvVar: "LVM_SNAPSHOTTER_TRACE_ENDPOINT",
+	},
+	cli.StringFlag{
+		Name:   "trace-file",
+		Usage:  "file the file exporter appends traces to",
+		EnvVar: "LVM_SNAPSHOTTER_TRACE_FILE",
+	},
+}
+
+// loadConfigFile reads the configuration file. Keys neither the daemon nor
+// the snapshotter know are rejected, as they are most likely typos.
+func loadConfigFile(path string, config *daemonConfig) error {
+	daemonMeta, err := toml.DecodeFile(path, &config.daemonSettings)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to parse config file %s", path)
+	}
+	snapMeta, err := toml.DecodeFile(path, &config.Snapshotter)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to parse config file %s", path)
+	}
+
+	// Each decode leaves the keys of the other undecoded, keys left by
+	// both are unknown.
+	skipped := map[string]bool{}
+	for _, k := range snapMeta.Undecoded() {
+		skipped[k.String()] = true
+	}
+	var unknown []string
+	for _, k := range daemonMeta.Undecoded() {
+		if skipped[k.String()] {
+			unknown = append(unknown, k.String())
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.Errorf("Unknown keys in config file %s: %s", path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// loadConfig builds the configuration from the configuration file, then the
+// environment and the flags, the latter taking precedence
+func loadConfig(c *cli.Context) (*daemonConfig, error) {
+	config := &daemonConfig{}
+	if path := c.GlobalString("config"); path != "" {
+		if err := loadConfigFile(path, config); err != nil {
+			return nil, err
+		}
+	}
+
+	overrides := map[string]*string{
+		"addr":            &config.Address,
+		"vgname":          &config.Snapshotter.VgName,
+		"lvpoolname":      &config.Snapshotter.ThinPool,
+		"root-path":       &config.Snapshotter.RootPath,
+		"img-size":        &config.Snapshotter.ImageSize,
+		"fs-type":         &config.Snapshotter.FsType,
+		"socket-mode":     &config.SocketMode,
+		"socket-group":    &config.SocketGroup,
+		"log-level":       &config.LogLevel,
+		"log-format":      &config.LogFormat,
+		"metrics-addr":    &config.MetricsAddress,
+		"health-interval": &config.HealthInterval,
+		"trace-exporter":  &config.Tracing.Exporter,
+		"trace-endpoint":  &config.Tracing.Endpoint,
+		"trace-file":      &config.Tracing.Path,
+	}
+	for name, value := range overrides {
+		if c.GlobalIsSet(name) {
+			*value = c.GlobalString(name)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the daemon settings and the snapshotter configuration and
+// sets the defaults
+func (c *daemonConfig) Validate() error {
+	if c.SocketMode == "" {
+		c.SocketMode = defaultSocketMode
+	}
+	if _, err := c.socketMode(); err != nil {
+		return err
+	}
+	if _, err := c.socketGID(); err != nil {
+		return err
+	}
+	if c.HealthInterval == "" {
+		c.HealthInterval = defaultHealthInterval
+	}
+	if d, err := time.ParseDuration(c.HealthInterval); err != nil || d <= 0 {
+		return errors.Errorf("invalid health_interval %q, expected a positive duration like %s", c.HealthInterval, defaultHealthInterval)
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return err
+	}
+	if c.LogLevel != "" {
+		if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+			return errors.Wrap(err, "invalid log_level")
+		}
+	}
+	switch c.LogFormat {
+	case "", log.TextFormat, log.JSONFormat:
+	default:
+		return errors.Errorf("invalid log_format %q, expected %s or %s", c.LogFormat, log.TextFormat, log.JSONFormat)
+	}
+	if err := c.Snapshotter.Validate(""); err != nil {
+		return errors.Wrap(err, "Failed to validate config")
+	}
+	return nil
+}
+
+// setupLogging applies the log level and format to the standard logger, the
+// one the snapshotter logs through
+func (c *daemonConfig) setupLogging() {
+	if c.LogLevel != "" {
+		level, _ := logrus.ParseLevel(c.LogLevel)
+		logrus.SetLevel(level)
+	}
+	if c.LogFormat == log.JSONFormat {
+		logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: log.RFC3339NanoFixed})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{TimestampFormat: log.RFC3339NanoFixed, FullTimestamp: true})
+	}
+}
+
+func (c *daemonConfig) socketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.Errorf("invalid socket_mode %q, expected octal permissions like %s", c.SocketMode, defaultSocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// socketGID returns the ID of the group owning the socket, -1 to leave it
+func (c *daemonConfig) socketGID() (int, error) {
+	if c.SocketGroup == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(c.SocketGroup); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(c.SocketGroup)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid socket_group %q", c.SocketGroup)
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli"
+	"gotest.tools/assert"
+)
+
+// runLoadConfig loads the configuration the way the daemon does for the
+// given command line
+func runLoadConfig(t *testing.T, args ...string) (*daemonConfig, error) {
+	var (
+		config *daemonConfig
+		err    error
+	)
+	app := cli.NewApp()
+	app.Flags = configFlags
+	app.Action = func(c *cli.Context) error {
+		config, err = loadConfig(c)
+		return nil
+	}
+	assert.NilError(t, app.Run(append([]string{"lvm-snapshotter"}, args...)))
+	return config, err
+}
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "lvm-config-")
+	assert.NilError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.toml")
+	assert.NilError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+address = "/run/lvm.sock"
+socket_mode = "0600"
+log_level = "debug"
+log_format = "json"
+
+vol_group = "vgfile"
+thin_pool = "poolfile"
+img_size = "20G"
+fs_type = "ext4"
+
+[encryption]
+  enabled = true
+
+[tracing]
+  exporter = "otlp"
+`)
+	config, err := runLoadConfig(t, "--config", path)
+	assert.NilError(t, err)
+	assert.Equal(t, config.Address, "/run/lvm.sock")
+	assert.Equal(t, config.SocketMode, "0600")
+	assert.Equal(t, config.LogLevel, "debug")
+	assert.Equal(t, config.LogFormat, "json")
+	assert.Equal(t, config.Snapshotter.VgName, "vgfile")
+	assert.Equal(t, config.Snapshotter.ThinPool, "poolfile")
+	assert.Equal(t, config.Snapshotter.ImageSize, "20GB")
+	assert.Equal(t, config.Snapshotter.FsType, "ext4")
+	assert.Assert(t, config.Snapshotter.Encryption.Enabled)
+	assert.Equal(t, config.Tracing.Exporter, "otlp")
+	assert.Equal(t, config.Tracing.Endpoint, defaultTraceEndpoint)
+
+	// Flags and environment variables take precedence over the file
+	os.Setenv("LVM_SNAPSHOTTER_FS_TYPE", "xfs")
+	defer os.Unsetenv("LVM_SNAPSHOTTER_FS_TYPE")
+	config, err = runLoadConfig(t, "--config", path, "--vgname", "vgflag")
+	assert.NilError(t, err)
+	assert.Equal(t, config.Snapshotter.VgName, "vgflag")
+	assert.Equal(t, config.Snapshotter.ThinPool, "poolfile")
+	assert.Equal(t, config.Snapshotter.FsType, "xfs")
+}
+
+func TestLoadConfigFlagsOnly(t *testing.T) {
+	config, err := runLoadConfig(t, "--addr", "/run/lvm.sock", "--vgname", "vg", "--lvpoolname", "pool")
+	assert.NilError(t, err)
+	assert.Equal(t, config.SocketMode, defaultSocketMode)
+	assert.Equal(t, config.Snapshotter.FsType, "xfs")
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := writeConfig(t, `
+vol_group = "vg"
+thin_pool = "pool"
+thinpool = "typo"
+
+[encryption]
+  enabeld = true
+`)
+	_, err := runLoadConfig(t, "--config", path)
+	assert.ErrorContains(t, err, "Unknown keys in config file "+path+": encryption.enabeld, thinpool")
+
+	_, err = runLoadConfig(t, "--config", writeConfig(t, "vol_group = ["))
+	assert.ErrorContains(t, err, "Unable to parse config file")
+
+	_, err = runLoadConfig(t, "--vgname", "vg", "--lvpoolname", "pool", "--socket-mode", "rw")
+	assert.ErrorContains(t, err, "invalid socket_mode")
+
+	_, err = runLoadConfig(t, "--vgname", "vg", "--lvpoolname", "pool", "--log-level", "loud")
+	assert.ErrorContains(t, err, "invalid log_level")
+
+	_, err = runLoadConfig(t, "--vgname", "vg", "--lvpoolname", "pool", "--log-format", "xml")
+	assert.ErrorContains(t, err, "invalid log_format")
+
+	_, err = runLoadConfig(t, "--vgname", "vg", "--lvpoolname", "pool", "--trace-exporter", "jaeger")
+	assert.ErrorContains(t, err, "invalid tracing exporter")
+
+	_, err = runLoadConfig(t, "--vgname", "vg", "--lvpoolname", "pool", "--trace-exporter", "file")
+	assert.ErrorContains(t, err, "tracing path is required")
+
+	_, err = runLoadConfig(t, "--vgname", "vg")
+	assert.ErrorContains(t, err, "Need both vol_group and thin_pool")
+}
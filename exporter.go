@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// newOTLPExporter posts spans to an OTLP/HTTP endpoint, like the receiver of
+// an OpenTelemetry collector
+func newOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid tracing endpoint %q", endpoint)
+	}
+	opts := []otlphttp.Option{
+		otlphttp.WithEndpoint(u.Host),
+		otlphttp.WithTracesURLPath(u.Path),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlphttp.WithInsecure())
+	}
+	exporter, err := otlp.NewExporter(context.Background(), otlphttp.NewDriver(opts...))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to export spans to %s", endpoint)
+	}
+	return exporter, nil
+}
+
+// fileExporter appends spans to a file as JSON, one batch per line
+type fileExporter struct {
+	*stdout.Exporter
+	file *os.File
+}
+
+func newFileExporter(path string) (sdktrace.SpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open trace file %s", path)
+	}
+	exporter, err := stdout.NewExporter(stdout.WithWriter(f), stdout.WithoutMetricExport())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileExporter{Exporter: exporter, file: f}, nil
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.Exporter.Shutdown(ctx)
+	if cerr := e.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
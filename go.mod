@@ -3,14 +3,28 @@ module github.com/ganeshmaharaj/lvm-snapshotter
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/Microsoft/hcsshim v0.8.15 // indirect
 	github.com/containerd/containerd v1.5.0-beta.1
 	github.com/containerd/continuity v0.0.0-20201208142359-180525291bb7
 	github.com/docker/distribution v2.7.1+incompatible // indirect
 	github.com/docker/go-units v0.4.0
+	github.com/gogo/protobuf v1.3.2
+	github.com/moby/sys/mountinfo v0.4.0
 	github.com/opencontainers/image-spec v1.0.1 // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/sirupsen/logrus v1.7.0
 	github.com/urfave/cli v1.22.2
-	google.golang.org/grpc v1.30.0
+	go.etcd.io/bbolt v1.3.5
+	go.opentelemetry.io/otel v0.20.0
+	go.opentelemetry.io/otel/exporters/otlp v0.20.0
+	go.opentelemetry.io/otel/exporters/stdout v0.20.0
+	go.opentelemetry.io/otel/sdk v0.20.0
+	go.opentelemetry.io/otel/trace v0.20.0
+	go.opentelemetry.io/proto/otlp v0.7.0
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
+	google.golang.org/grpc v1.37.0
+	google.golang.org/protobuf v1.26.0
 	gotest.tools v2.2.0+incompatible
 )
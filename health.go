@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+const defaultHealthInterval = "10s"
+
+// lazySnapshotter lets the services be registered before the snapshotter is
+// initialized, which the gate keeps them from calling
+type lazySnapshotter struct {
+	lvms.Snapshotter
+}
+
+// States of the ready gate
+const (
+	gateInitializing int32 = iota
+	gateOpen
+	gateClosed
+)
+
+// readyGate rejects calls to anything but the health service until the
+// snapshotter is initialized and reconciled, and again once the daemon is
+// shutting down
+type readyGate struct {
+	ready int32
+}
+
+func (g *readyGate) open() {
+	atomic.CompareAndSwapInt32(&g.ready, gateInitializing, gateOpen)
+}
+
+// close rejects new calls and tells whether the gate was open
+func (g *readyGate) close() bool {
+	return atomic.SwapInt32(&g.ready, gateClosed) == gateOpen
+}
+
+func (g *readyGate) check(srv interface{}) error {
+	if _, ok := srv.(healthpb.HealthServer); ok {
+		return nil
+	}
+	switch atomic.LoadInt32(&g.ready) {
+	case gateInitializing:
+		return status.Error(codes.Unavailable, "snapshotter is initializing")
+	case gateClosed:
+		return status.Error(codes.Unavailable, "snapshotter is shutting down")
+	}
+	return nil
+}
+
+func (g *readyGate) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := g.check(info.Server); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *readyGate) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := g.check(srv); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// healthReporter drives the status of the health service and opens the gate.
+// Every service is NOT_SERVING until the snapshotter is initialized and
+// reconciled, and again whenever the periodic probe finds its pools or
+// metadata volume unavailable.
+type healthReporter struct {
+	server     *health.Server
+	gate       *readyGate
+	services   []string
+	sn         lvms.Snapshotter
+	reconciled bool
+}
+
+func newHealthReporter(server *health.Server, gate *readyGate, services ...string) *healthReporter {
+	h := &healthReporter{
+		server:   server,
+		gate:     gate,
+		services: append([]string{""}, services...),
+	}
+	h.set(healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+func (h *healthReporter) set(status healthpb.HealthCheckResponse_ServingStatus) {
+	for _, s := range h.services {
+		h.server.SetServingStatus(s, status)
+	}
+}
+
+// probe checks the snapshotter and updates the status. The metadata is
+// reconciled with the pools once before the first SERVING, which opens the
+// gate.
+func (h *healthReporter) probe(ctx context.Context) {
+	if err := h.sn.Check(ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("Health probe failed")
+		h.set(healthpb.HealthCheckResponse_NOT_SERVING)
+		return
+	}
+	if !h.reconciled {
+		report, err := h.sn.Reconcile(ctx, false)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("Unable to reconcile metadata with the pools")
+			h.set(healthpb.HealthCheckResponse_NOT_SERVING)
+			return
+		}
+		log.G(ctx).WithField("orphans", report.OrphanVolumes).
+			WithField("missing", report.MissingVolumes).
+			WithField("stale", report.StaleRecords).
+			Info("Reconciled metadata with the pools")
+		h.reconciled = true
+		h.gate.open()
+	}
+	h.set(healthpb.HealthCheckResponse_SERVING)
+}
+
+// run probes the snapshotter right away and then every interval until the
+// context is done
+func (h *healthReporter) run(ctx context.Context, sn lvms.Snapshotter, interval time.Duration) {
+	h.sn = sn
+	h.probe(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.probe(ctx)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"gotest.tools/assert"
+
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+// probedSnapshotter fails its checks and reconciliation on demand
+type probedSnapshotter struct {
+	lvms.Snapshotter
+	checkErr     error
+	reconcileErr error
+	reconciles   int
+}
+
+func (p *probedSnapshotter) Check(ctx context.Context) error {
+	return p.checkErr
+}
+
+func (p *probedSnapshotter) Reconcile(ctx context.Context, remove bool) (lvms.ReconcileReport, error) {
+	p.reconciles++
+	return lvms.ReconcileReport{}, p.reconcileErr
+}
+
+func servingStatus(t *testing.T, server *health.Server, service string) healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	assert.NilError(t, err)
+	return resp.Status
+}
+
+func TestHealthReporter(t *testing.T) {
+	ctx := context.Background()
+	server := health.NewServer()
+	gate := &readyGate{}
+	h := newHealthReporter(server, gate, snapshotsServiceName)
+	assert.Equal(t, servingStatus(t, server, ""), healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.Equal(t, servingStatus(t, server, snapshotsServiceName), healthpb.HealthCheckResponse_NOT_SERVING)
+
+	sn := &probedSnapshotter{reconcileErr: errors.New("lvs failed")}
+	h.sn = sn
+	h.probe(ctx)
+	assert.Equal(t, servingStatus(t, server, ""), healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.Equal(t, atomic.LoadInt32(&gate.ready), int32(0))
+
+	sn.reconcileErr = nil
+	h.probe(ctx)
+	assert.Equal(t, servingStatus(t, server, ""), healthpb.HealthCheckResponse_SERVING)
+	assert.Equal(t, atomic.LoadInt32(&gate.ready), int32(1))
+	assert.Equal(t, servingStatus(t, server, snapshotsServiceName), healthpb.HealthCheckResponse_SERVING)
+
+	sn.checkErr = errors.New("volume group is gone")
+	h.probe(ctx)
+	assert.Equal(t, servingStatus(t, server, snapshotsServiceName), healthpb.HealthCheckResponse_NOT_SERVING)
+
+	// Reconciliation only happens once
+	sn.checkErr = nil
+	h.probe(ctx)
+	assert.Equal(t, servingStatus(t, server, ""), healthpb.HealthCheckResponse_SERVING)
+	assert.Equal(t, sn.reconciles, 2)
+}
+
+func TestReadyGate(t *testing.T) {
+	gate := &readyGate{}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "done", nil
+	}
+
+	_, err := gate.intercept(context.Background(), nil, &grpc.UnaryServerInfo{Server: &probedSnapshotter{}}, handler)
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+
+	resp, err := gate.intercept(context.Background(), nil, &grpc.UnaryServerInfo{Server: health.NewServer()}, handler)
+	assert.NilError(t, err)
+	assert.Equal(t, resp, "done")
+
+	gate.open()
+	resp, err = gate.intercept(context.Background(), nil, &grpc.UnaryServerInfo{Server: &probedSnapshotter{}}, handler)
+	assert.NilError(t, err)
+	assert.Equal(t, resp, "done")
+
+	// A closed gate stays closed
+	assert.Assert(t, gate.close())
+	gate.open()
+	_, err = gate.intercept(context.Background(), nil, &grpc.UnaryServerInfo{Server: &probedSnapshotter{}}, handler)
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+	assert.Assert(t, !gate.close())
+}
@@ -0,0 +1,152 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// InspectMounts activates the volume of the snapshot key, whatever its kind,
+// and returns read-only mounts of it for inspection. Journals are not
+// replayed, so the volume is left untouched even if it was not cleanly
+// unmounted. Views of protected snapshots are inspected through the volume
+// they view, without dm-verity.
+func (o *snapshotter) InspectMounts(ctx context.Context, key string) (_ []mount.Mount, err error) {
+	ctx, span := startSpan(ctx, "lvm.InspectMounts", attribute.String("snapshot.key", key))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	ctx, t, err := o.transaction(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if rerr := t.Rollback(); rerr != nil {
+			log.G(ctx).WithError(rerr).Warn("Failed to rollback transaction")
+		}
+	}()
+
+	id, _, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withSnapshotID(ctx, id)
+	vol, err := o.volume(t, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReady(vol, key); err != nil {
+		return nil, err
+	}
+	if vol.VerityOf != "" {
+		id = vol.VerityOf
+		if vol, err = o.volume(t, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.activateVolume(ctx, vol, id); err != nil {
+		return nil, errors.Wrap(err, "Unable to activate volume")
+	}
+
+	options := []string{"ro"}
+	switch o.config.FsType {
+	case "xfs":
+		options = append(options, "norecovery", "nouuid")
+	case "ext4":
+		options = append(options, "noload")
+	}
+	device := filepath.Join("/dev", vol.VgName, id)
+	if vol.Encrypted {
+		device = cryptDevice(vol.VgName, id)
+	}
+	return []mount.Mount{
+		{
+			Source:  device,
+			Type:    o.config.FsType,
+			Options: options,
+		},
+	}, nil
+}
+
+// Teardown detaches the mounts of every snapshot and deactivates their
+// volumes, leaving nothing but the metavolume in use. It goes on after
+// failures and returns the first one.
+func (o *snapshotter) Teardown(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "lvm.Teardown")
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, "")
+	ctx, t, err := o.transaction(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := t.Rollback(); rerr != nil {
+			log.G(ctx).WithError(rerr).Warn("Failed to rollback transaction")
+		}
+	}()
+
+	var firstErr error
+	fail := func(err error) {
+		log.G(ctx).WithError(err).Warn("Teardown failed")
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	// Views of protected snapshots sit on the volume they view, which can
+	// only be deactivated once they are closed.
+	var volumes []string
+	records := map[string]volume{}
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		id, _, _, err := storage.GetInfo(ctx, info.Name)
+		if err != nil {
+			return err
+		}
+		vol, err := o.volume(t, id)
+		if err != nil {
+			return err
+		}
+		if err := unmountDevice(ctx, o.getSnapshotDir(vol, id)); err != nil {
+			fail(errors.Wrapf(err, "Unable to unmount %s", info.Name))
+		}
+		if vol.VerityOf != "" {
+			if out, err := verityClose(ctx, verityName(vol.VgName, id)); err != nil {
+				fail(errors.Wrapf(err, "Unable to close verity device of %s: %s", info.Name, out))
+			}
+			return nil
+		}
+		volumes = append(volumes, id)
+		records[id] = vol
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, id := range volumes {
+		if err := o.deactivateVolume(ctx, records[id], id); err != nil {
+			fail(errors.Wrapf(err, "Unable to deactivate volume %s", id))
+		}
+	}
+	return firstErr
+}
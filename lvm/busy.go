@@ -0,0 +1,183 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"os"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/moby/sys/mountinfo"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// deviceMounts returns the mount points of the block device in the mount
+// namespace of the snapshotter
+func deviceMounts(device string) ([]string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(device, &st); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Unable to stat %s", device)
+	}
+	major, minor := int(unix.Major(uint64(st.Rdev))), int(unix.Minor(uint64(st.Rdev)))
+
+	infos, err := mountinfo.GetMounts(func(i *mountinfo.Info) (bool, bool) {
+		return i.Major != major || i.Minor != minor, false
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read mountinfo")
+	}
+	var mountpoints []string
+	for _, i := range infos {
+		mountpoints = append(mountpoints, i.Mountpoint)
+	}
+	return mountpoints, nil
+}
+
+func freezeFS(ctx context.Context, mountpoint string) (string, error) {
+	cmd := "fsfreeze"
+	args := []string{"--freeze", mountpoint}
+	return runCommandOnce(ctx, cmd, args)
+}
+
+func thawFS(ctx context.Context, mountpoint string) (string, error) {
+	cmd := "fsfreeze"
+	args := []string{"--unfreeze", mountpoint}
+	return runCommand(ctx, cmd, args)
+}
+
+// releaseDevice deals with mounts of the device that are still around when a
+// snapshot is committed, removed or reset, according to the busy policy. With
+// the freeze policy, the mount points of a volume that can be detached from
+// its snapshot are returned for the caller to detach it. Removal and reset
+// never detach, a busy volume can not be removed unless lazy unmounts are
+// allowed.
+func (o *snapshotter) releaseDevice(ctx context.Context, key string, device string, canDetach bool) ([]string, error) {
+	if o.config.BusyPolicy == BusyLazyUnmount {
+		return nil, unmountDevice(ctx, device)
+	}
+
+	mountpoints, err := deviceMounts(device)
+	if err != nil {
+		return nil, err
+	}
+	if len(mountpoints) == 0 {
+		return nil, nil
+	}
+	if o.config.BusyPolicy != BusyFreeze || !canDetach {
+		return nil, errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q is still mounted at %v", key, mountpoints)
+	}
+	return mountpoints, nil
+}
+
+// detachVolume leaves the mounted volume of a snapshot being committed to its
+// mounts. A thin snapshot of the volume, taken while its filesystems are
+// frozen, takes over the name of the volume and becomes the committed layer,
+// so nothing written after the commit ends up in it. The mounted volume is
+// renamed and deleted by Cleanup once it is unmounted. The steps are undone
+// through undo.
+func (o *snapshotter) detachVolume(ctx context.Context, key string, vol volume, id string, undo *undoStack) error {
+	if vol.Encrypted {
+		// The crypt mapping of the mounted volume is named after the
+		// volume, the committed layer could never be opened next to it
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "encrypted snapshot %q is still mounted", key)
+	}
+	copylv := commitLVName(id)
+	if err := o.snapshotActiveVolume(ctx, vol, id, copylv); err != nil {
+		return err
+	}
+	undo.push("delete committed copy", func(ctx context.Context) error {
+		_, err := removeLVMVolume(ctx, vol.VgName, copylv)
+		return err
+	})
+
+	detached := detachedLVName(id)
+	if out, err := renameLVMVolume(ctx, vol.VgName, id, detached); err != nil {
+		return errors.Wrapf(err, "Unable to rename mounted volume: %s", out)
+	}
+	undo.push("rename mounted volume back", func(ctx context.Context) error {
+		_, err := renameLVMVolume(ctx, vol.VgName, detached, id)
+		return err
+	})
+	if out, err := renameLVMVolume(ctx, vol.VgName, copylv, id); err != nil {
+		return errors.Wrapf(err, "Unable to rename committed copy: %s", out)
+	}
+	undo.push("rename committed copy back", func(ctx context.Context) error {
+		_, err := renameLVMVolume(ctx, vol.VgName, id, copylv)
+		return err
+	})
+	if _, err := toggleactivateLV(ctx, vol.VgName, id, true); err != nil {
+		return errors.Wrap(err, "Unable to activate committed copy")
+	}
+	undo.push("deactivate committed copy", func(ctx context.Context) error {
+		_, err := toggleactivateLV(ctx, vol.VgName, id, false)
+		return err
+	})
+	log.G(ctx).Warnf("Snapshot %s is still mounted, its volume was detached as %s", key, detached)
+	return nil
+}
+
+// snapshotActiveVolume takes a thin snapshot of an active volume, freezing
+// the filesystems mounted from it so the snapshot is consistent
+func (o *snapshotter) snapshotActiveVolume(ctx context.Context, vol volume, id string, newID string) error {
+	mountpoints, err := deviceMounts(o.getSnapshotDir(vol, id))
+	if err != nil {
+		return err
+	}
+	var frozen []string
+	defer func() {
+		o.thaw(ctx, frozen)
+	}()
+	for _, mp := range mountpoints {
+		if out, err := freezeFS(ctx, mp); err != nil {
+			return errors.Wrapf(err, "Unable to freeze %s: %s", mp, out)
+		}
+		frozen = append(frozen, mp)
+	}
+
+	if out, err := createLVMVolume(ctx, newID, vol.VgName, vol.ThinPool, o.config.ImageSize, id, snapshots.KindUnknown); err != nil {
+		return errors.Wrapf(err, "Unable to snapshot volume %s: %s", id, out)
+	}
+	return nil
+}
+
+// commitLVName is the name of the copy of a mounted volume that becomes the
+// committed layer
+func commitLVName(lvname string) string {
+	return lvname + "-commit"
+}
+
+// detachedLVName is the name a mounted volume is left under once its copy
+// was committed
+func detachedLVName(lvname string) string {
+	return lvname + "-detached"
+}
+
+func (o *snapshotter) thaw(ctx context.Context, mountpoints []string) {
+	for _, mp := range mountpoints {
+		if out, err := thawFS(ctx, mp); err != nil {
+			log.G(ctx).WithError(err).Warnf("Unable to thaw %s: %s", mp, out)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDeviceMounts(t *testing.T) {
+	mountpoints, err := deviceMounts("/dev/vgthin/does-not-exist")
+	assert.NilError(t, err)
+	assert.Equal(t, len(mountpoints), 0)
+
+	// Nothing is ever mounted from /dev/null
+	mountpoints, err = deviceMounts("/dev/null")
+	assert.NilError(t, err)
+	assert.Equal(t, len(mountpoints), 0)
+}
+
+func TestReleaseUnmountedDevice(t *testing.T) {
+	ctx := context.Background()
+	for _, policy := range []string{"", BusyFail, BusyFreeze} {
+		o := &snapshotter{config: &SnapConfig{BusyPolicy: policy}}
+		mounted, err := o.releaseDevice(ctx, "key", "/dev/null", true)
+		assert.NilError(t, err)
+		assert.Equal(t, len(mounted), 0)
+	}
+}
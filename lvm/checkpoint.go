@@ -0,0 +1,200 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// LabelCheckpoint set through Update on an active snapshot checkpoints
+	// it into a committed snapshot named after the value of the label. The
+	// label itself is never stored.
+	LabelCheckpoint = "containerd.io/snapshot/lvm.checkpoint"
+
+	// LabelCheckpointSource holds the key of the active snapshot a
+	// checkpoint was taken from
+	LabelCheckpointSource = "containerd.io/snapshot/lvm.checkpoint.source"
+)
+
+// takeCheckpointLabel removes the checkpoint label from an update. It returns
+// the requested checkpoint name, the remaining fieldpaths and whether there is
+// anything left to update.
+func takeCheckpointLabel(info *snapshots.Info, fieldpaths []string) (string, []string, bool) {
+	name, ok := info.Labels[LabelCheckpoint]
+	if !ok {
+		return "", fieldpaths, true
+	}
+
+	labels := make(map[string]string, len(info.Labels))
+	for k, v := range info.Labels {
+		if k != LabelCheckpoint {
+			labels[k] = v
+		}
+	}
+	info.Labels = labels
+
+	if len(fieldpaths) == 0 {
+		return name, fieldpaths, true
+	}
+	var paths []string
+	for _, p := range fieldpaths {
+		if p != "labels."+LabelCheckpoint {
+			paths = append(paths, p)
+		}
+	}
+	return name, paths, len(paths) > 0
+}
+
+// Checkpoint captures the current state of the active snapshot key into a new
+// committed snapshot called name, sharing the parent of the active snapshot.
+// The active snapshot stays usable: its filesystem is only frozen while a
+// thin snapshot of its volume is taken.
+func (o *snapshotter) Checkpoint(ctx context.Context, name, key string, opts ...snapshots.Opt) (err error) {
+	ctx, span := startSpan(ctx, "lvm.Checkpoint", attribute.String("snapshot.key", key), attribute.String("snapshot.name", name))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	log.G(ctx).Debugf("Checkpoint snapshot for key %s as %s", key, name)
+	srcID, unlock, err := o.lockSnapshot(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ctx = withSnapshotID(ctx, srcID)
+
+	// The checkpoint goes through the regular active to committed path of
+	// the metastore under a transient key, which is reserved up front.
+	tmpKey := fmt.Sprintf("checkpoint-%s-%d", key, time.Now().UnixNano())
+	var (
+		s       storage.Snapshot
+		srcVol  volume
+		release func()
+	)
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		_, info, _, err := storage.GetInfo(ctx, key)
+		if err != nil {
+			return err
+		}
+		if info.Kind != snapshots.KindActive {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q is not active", key)
+		}
+		if srcVol, err = o.volume(t, srcID); err != nil {
+			return err
+		}
+		if err := checkReady(srcVol, key); err != nil {
+			return err
+		}
+		if srcVol.VerityOf != "" {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q has no volume of its own", key)
+		}
+		// Nothing mounted from a block volume can be frozen
+		if srcVol.Block {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q is a block device", key)
+		}
+		if s, err = storage.CreateSnapshot(ctx, snapshots.KindActive, tmpKey, info.Parent); err != nil {
+			return errors.Wrap(err, "failed to create checkpoint")
+		}
+		pending := srcVol
+		pending.VerityHash = ""
+		if err := putIntent(t, s.ID, intent{Op: intentCreate, Key: tmpKey, Volume: pending}); err != nil {
+			return errors.Wrap(err, "Unable to record create intent")
+		}
+		pending.State = volumeCreating
+		if err := putVolume(t, s.ID, pending); err != nil {
+			return errors.Wrap(err, "Unable to record volume")
+		}
+		release, err = o.locks.reserve(s.ID)
+		return err
+	}); err != nil {
+		if release != nil {
+			release()
+		}
+		return err
+	}
+	defer release()
+	var undo undoStack
+	defer func() {
+		if err != nil {
+			o.abandonSnapshot(ctx, tmpKey, s.ID, undo.run(ctx))
+		}
+	}()
+
+	vol := srcVol
+	vol.VerityHash = ""
+	if err = o.snapshotActiveVolume(ctx, srcVol, srcID, s.ID); err != nil {
+		return err
+	}
+	undo.push("delete checkpoint volume", func(ctx context.Context) error {
+		_, err := removeLVMVolume(ctx, vol.VgName, s.ID)
+		return err
+	})
+
+	var usage snapshots.Usage
+	if err = o.activateVolume(ctx, vol, s.ID); err != nil {
+		return errors.Wrap(err, "Unable to activate checkpoint volume")
+	}
+	active := vol
+	undo.push("deactivate checkpoint volume", func(ctx context.Context) error {
+		return o.deactivateVolume(ctx, active, s.ID)
+	})
+	mounts := o.mounts(storage.Snapshot{ID: s.ID, Kind: snapshots.KindView}, vol)
+	if err = withTempMount(ctx, mounts, func(root string) error {
+		du, err := fs.DiskUsage(ctx, root)
+		usage = snapshots.Usage(du)
+		return err
+	}); err != nil {
+		return errors.Wrap(err, "Unable to compute checkpoint usage")
+	}
+
+	if o.config.Verity {
+		if vol.VerityHash, err = o.protectVolume(ctx, vol, s.ID, &undo); err != nil {
+			return errors.Wrap(err, "Unable to protect checkpoint with dm-verity")
+		}
+		opts = append(opts[:len(opts):len(opts)], withLabel(LabelVerityRootHash, vol.VerityHash))
+	}
+	opts = append(opts[:len(opts):len(opts)], withLabel(LabelCheckpointSource, key))
+
+	if err = o.deactivateVolume(ctx, vol, s.ID); err != nil {
+		return errors.Wrap(err, "Unable to deactivate checkpoint volume")
+	}
+
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if _, err := storage.CommitActive(ctx, tmpKey, name, usage, opts...); err != nil {
+			return errors.Wrap(err, "failed to commit checkpoint")
+		}
+		if err := putVolume(t, s.ID, vol); err != nil {
+			return errors.Wrap(err, "Unable to record volume")
+		}
+		return deleteIntent(t, s.ID)
+	}); err != nil {
+		return err
+	}
+	o.notify(ctx, Event{Type: EventCommitted}, name)
+	return nil
+}
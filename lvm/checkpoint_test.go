@@ -0,0 +1,68 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"gotest.tools/assert"
+)
+
+func TestTakeCheckpointLabel(t *testing.T) {
+	info := snapshots.Info{Name: "active", Labels: map[string]string{"foo": "bar"}}
+	name, paths, update := takeCheckpointLabel(&info, []string{"labels.foo"})
+	assert.Equal(t, name, "")
+	assert.DeepEqual(t, paths, []string{"labels.foo"})
+	assert.Assert(t, update)
+
+	info.Labels[LabelCheckpoint] = "ckpt"
+	name, paths, update = takeCheckpointLabel(&info, []string{"labels." + LabelCheckpoint})
+	assert.Equal(t, name, "ckpt")
+	assert.Equal(t, len(paths), 0)
+	assert.Assert(t, !update)
+	assert.DeepEqual(t, info.Labels, map[string]string{"foo": "bar"})
+
+	info.Labels[LabelCheckpoint] = "ckpt"
+	name, paths, update = takeCheckpointLabel(&info, []string{"labels.foo", "labels." + LabelCheckpoint})
+	assert.Equal(t, name, "ckpt")
+	assert.DeepEqual(t, paths, []string{"labels.foo"})
+	assert.Assert(t, update)
+
+	// Without fieldpaths all labels are replaced, minus the checkpoint one
+	info.Labels[LabelCheckpoint] = "ckpt"
+	name, paths, update = takeCheckpointLabel(&info, nil)
+	assert.Equal(t, name, "ckpt")
+	assert.Equal(t, len(paths), 0)
+	assert.Assert(t, update)
+	_, ok := info.Labels[LabelCheckpoint]
+	assert.Assert(t, !ok)
+}
+
+func TestCheckpointBlockSource(t *testing.T) {
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		_, err := o.Prepare(ctx, "active", "", snapshots.WithLabels(map[string]string{LabelMountMode: MountModeBlock}))
+		assert.NilError(t, err)
+		err = o.Checkpoint(ctx, "ckpt", "active")
+		assert.Assert(t, errdefs.IsFailedPrecondition(err), err)
+		assertConsistent(ctx, t, o, f, "checkpoint")
+	})
+}
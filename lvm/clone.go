@@ -0,0 +1,145 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// LabelCloneSource holds the key of the active snapshot a clone was created
+// from
+const LabelCloneSource = "containerd.io/snapshot/lvm.clone.source"
+
+// Clone creates the active snapshot key as a copy of the current state of the
+// active snapshot source. Both share the same parent and the source stays
+// usable, its filesystem is only frozen while a thin snapshot of its volume is
+// taken.
+func (o *snapshotter) Clone(ctx context.Context, key, source string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	ctx, span := startSpan(ctx, "lvm.Clone", attribute.String("snapshot.key", key), attribute.String("snapshot.source", source))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	log.G(ctx).Debugf("Clone snapshot %s into %s", source, key)
+	srcID, unlock, err := o.lockSnapshot(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var (
+		s       storage.Snapshot
+		srcVol  volume
+		release func()
+	)
+	opts = append(opts[:len(opts):len(opts)], withLabel(LabelCloneSource, source))
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		_, info, _, err := storage.GetInfo(ctx, source)
+		if err != nil {
+			return err
+		}
+		if info.Kind != snapshots.KindActive {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q is not active", source)
+		}
+		if srcVol, err = o.volume(t, srcID); err != nil {
+			return err
+		}
+		if err := checkReady(srcVol, source); err != nil {
+			return err
+		}
+		// The filesystem of a block volume can neither be frozen nor be
+		// given a new UUID while its log may be dirty
+		if srcVol.Block {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q is a block device", source)
+		}
+		if s, err = storage.CreateSnapshot(ctx, snapshots.KindActive, key, info.Parent, opts...); err != nil {
+			return errors.Wrap(err, "failed to create snapshot")
+		}
+		pending := srcVol
+		pending.VerityHash = ""
+		if err := putIntent(t, s.ID, intent{Op: intentCreate, Key: key, Volume: pending}); err != nil {
+			return errors.Wrap(err, "Unable to record create intent")
+		}
+		pending.State = volumeCreating
+		if err := putVolume(t, s.ID, pending); err != nil {
+			return errors.Wrap(err, "Unable to record volume")
+		}
+		release, err = o.locks.reserve(s.ID)
+		return err
+	}); err != nil {
+		if release != nil {
+			release()
+		}
+		return nil, err
+	}
+	defer release()
+	ctx = withSnapshotID(ctx, s.ID)
+	var undo undoStack
+	defer func() {
+		if err != nil {
+			o.abandonSnapshot(ctx, key, s.ID, undo.run(ctx))
+		}
+	}()
+
+	vol := srcVol
+	vol.VerityHash = ""
+	if err := o.snapshotActiveVolume(ctx, srcVol, srcID, s.ID); err != nil {
+		log.G(ctx).WithError(err).Warn("Unable to snapshot source volume")
+		return nil, errors.Wrap(err, "Unable to create volume")
+	}
+	undo.push("delete clone", func(ctx context.Context) error {
+		return o.removeVolume(ctx, vol, s.ID)
+	})
+
+	if err = o.activateVolume(ctx, vol, s.ID); err != nil {
+		log.G(ctx).WithError(err).Warn("Unable to activate clone")
+		return nil, errors.Wrap(err, "Unable to create volume")
+	}
+	undo.push("deactivate clone", func(ctx context.Context) error {
+		return o.deactivateVolume(ctx, vol, s.ID)
+	})
+
+	// The clone carries the UUID of the source, which keeps filesystems
+	// like xfs from mounting both at once.
+	if out, err := regenerateUUID(ctx, o.getSnapshotDir(vol, s.ID), o.config.FsType); err != nil {
+		log.G(ctx).WithError(err).Warnf("Unable to change filesystem UUID: %s", out)
+		return nil, errors.Wrap(err, "Unable to create volume")
+	}
+
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if err := putVolume(t, s.ID, vol); err != nil {
+			return err
+		}
+		return deleteIntent(t, s.ID)
+	}); err != nil {
+		return nil, errors.Wrap(err, "Unable to record volume")
+	}
+
+	mounts := o.mounts(s, vol)
+	log.G(ctx).Debugf("Mounts for snapshot %s is %+v", s.ID, mounts)
+	o.removeLostFound(ctx, mounts)
+	o.notify(ctx, Event{Type: EventCreated}, key)
+	return mounts, nil
+}
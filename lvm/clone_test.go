@@ -0,0 +1,38 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"gotest.tools/assert"
+)
+
+func TestCloneBlockSource(t *testing.T) {
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		_, err := o.Prepare(ctx, "active", "", snapshots.WithLabels(map[string]string{LabelMountMode: MountModeBlock}))
+		assert.NilError(t, err)
+		_, err = o.Clone(ctx, "clone", "active")
+		assert.Assert(t, errdefs.IsFailedPrecondition(err), err)
+		assertConsistent(ctx, t, o, f, "clone")
+	})
+}
@@ -19,7 +19,9 @@
 package lvm
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/pkg/errors"
@@ -29,8 +31,142 @@ const (
 	defaultImgSize  = "10G"
 	defaultFsType   = "xfs"
 	defaultRootPath = "/mnt"
+
+	defaultHookTimeout       = "10s"
+	defaultPoolCheckInterval = "30s"
+
+	// PolicyMostFree places new base volumes in the pool with the most free
+	// data space.
+	PolicyMostFree = "most-free"
+	// PolicyRoundRobin cycles through the pools for every new base volume.
+	PolicyRoundRobin = "round-robin"
+
+	// CrossPoolClone copies a parent living in another pool into a new base
+	// volume in the pool of the namespace.
+	CrossPoolClone = "clone"
+	// CrossPoolReject refuses to create snapshots from a parent living in
+	// another pool than the one of the namespace.
+	CrossPoolReject = "reject"
+
+	// MountModeFilesystem hands out snapshots to be mounted on the host
+	MountModeFilesystem = "filesystem"
+	// MountModeBlock hands out snapshots as raw block devices for VM based
+	// runtimes
+	MountModeBlock = "block"
+
+	// WipeZero discards removed volumes in a pool that zeroes the blocks it
+	// provisions
+	WipeZero = "zero"
+	// WipeOverwrite explicitly overwrites removed volumes
+	WipeOverwrite = "overwrite"
+	// WipeCryptoErase erases the LUKS keyslots of removed encrypted volumes.
+	// Volumes that are not encrypted or share their key with other volumes
+	// are zeroed instead.
+	WipeCryptoErase = "crypto-erase"
+
+	// BusyFail fails commits and removals of volumes that are still mounted
+	BusyFail = "fail"
+	// BusyFreeze freezes volumes that are still mounted while a copy of
+	// them is taken as the committed layer, leaving the mounted volume to
+	// its mounts
+	BusyFreeze = "freeze"
+	// BusyLazyUnmount lazily detaches all mounts of a volume
+	BusyLazyUnmount = "lazy-unmount"
+
+	// KeyProviderFile keeps a key file per volume in a local directory
+	KeyProviderFile = "keyfile"
+	// KeyProviderCommand asks an external command for the keys
+	KeyProviderCommand = "command"
 )
 
+// EncryptionConfig controls encryption at rest of the volumes with dm-crypt
+type EncryptionConfig struct {
+	// Encrypt every new base volume. The encryption label overrides this
+	// for individual snapshots.
+	Enabled bool `toml:"enabled"`
+
+	// Where keys come from, either keyfile or command (If empty, keyfile)
+	KeyProvider string `toml:"key_provider"`
+
+	// Directory holding the key files (If empty, "keys" under root_path)
+	KeyDir string `toml:"key_dir"`
+
+	// Executable invoked as "<key_command> create|get|delete <id>"
+	KeyCommand string `toml:"key_command"`
+}
+
+// PoolConfig describes an additional thin pool volumes can be placed in
+type PoolConfig struct {
+	// Name used to refer to the pool. Defaults to "<vol_group>/<thin_pool>"
+	Name string `toml:"name"`
+
+	// Volume group that holds the thin pool
+	VgName string `toml:"vol_group"`
+
+	// Logical volume thin pool to hold the volumes
+	ThinPool string `toml:"thin_pool"`
+
+	// Tier the pool belongs to, requested through the tier label
+	Tier string `toml:"tier"`
+}
+
+// DiscardConfig controls how blocks freed inside the volumes are returned to
+// the thin pool
+type DiscardConfig struct {
+	// Mount active snapshots with the discard option
+	Mount bool `toml:"mount"`
+
+	// Run fstrim on every volume before it is committed
+	TrimOnCommit bool `toml:"trim_on_commit"`
+
+	// Discard the whole volume before it is removed
+	OnRemove bool `toml:"on_remove"`
+}
+
+// HookConfig describes an executable run around snapshot operations. It
+// receives a HookEvent as JSON on standard input.
+type HookConfig struct {
+	// Path of the executable
+	Path string `toml:"path"`
+
+	// Arguments passed to the executable
+	Args []string `toml:"args"`
+
+	// Operations the hook runs around, among prepare, view, commit and
+	// remove (If empty, all of them)
+	Operations []string `toml:"operations"`
+
+	// Time a run may take before the hook is killed (If empty, 10s)
+	Timeout string `toml:"timeout"`
+}
+
+// HooksConfig holds the hooks run before and after snapshot operations. A pre
+// hook exiting with a non-zero status vetoes the operation, post hooks run
+// once it succeeded and can not undo it.
+type HooksConfig struct {
+	Pre  []HookConfig `toml:"pre"`
+	Post []HookConfig `toml:"post"`
+}
+
+// SchedulerConfig bounds the external commands run at once
+type SchedulerConfig struct {
+	// LVM commands run at once (If empty, 4)
+	LVMConcurrency int `toml:"lvm_concurrency"`
+
+	// mkfs commands run at once (If empty, 2)
+	MkfsConcurrency int `toml:"mkfs_concurrency"`
+}
+
+// NamespacePool maps containerd namespaces to the pool their volumes are
+// placed in
+type NamespacePool struct {
+	// Namespace name, or a namespace prefix when it ends with "*"
+	Namespace string `toml:"namespace"`
+
+	// Name of the pool the namespace uses
+	Pool string `toml:"pool"`
+}
+
 // SnapConfig will hold all the info to run the snapshotter
 type SnapConfig struct {
 	// Root directory of snapshotter
@@ -45,6 +181,59 @@ type SnapConfig struct {
 	// Characteristics of the volumes that we will create
 	ImageSize string `toml:"img_size"`
 	FsType    string `toml:"fs_type"`
+
+	// Additional thin pools new base volumes can be placed in
+	Pools []PoolConfig `toml:"pools"`
+
+	// Policy used to pick a pool for new base volumes (If empty, most-free)
+	PoolPolicy string `toml:"pool_policy"`
+
+	// Namespaces pinned to a pool. When set, volumes of unmapped namespaces
+	// are placed in DefaultPool.
+	Namespaces []NamespacePool `toml:"namespaces"`
+
+	// Pool used for namespaces without a mapping (If empty, the pool given by
+	// vol_group and thin_pool)
+	DefaultPool string `toml:"default_pool"`
+
+	// What to do when the parent of a snapshot lives in another pool than the
+	// namespace maps to, either clone or reject (If empty, clone)
+	CrossPoolParent string `toml:"cross_pool_parent"`
+
+	// Encryption at rest of the volumes
+	Encryption EncryptionConfig `toml:"encryption"`
+
+	// Protect committed snapshots with a dm-verity hash tree
+	Verity bool `toml:"verity"`
+
+	// How active snapshots are handed out, either filesystem or block (If
+	// empty, filesystem)
+	MountMode string `toml:"mount_mode"`
+
+	// Space reclamation of the volumes
+	Discard DiscardConfig `toml:"discard"`
+
+	// How removed volumes are wiped, either zero, overwrite or crypto-erase
+	// (If empty, volumes are not wiped)
+	WipePolicy string `toml:"wipe_policy"`
+
+	// What to do with volumes still mounted when they are committed or
+	// removed, either fail, freeze or lazy-unmount (If empty, fail)
+	BusyPolicy string `toml:"busy_policy"`
+
+	// Executables run before and after snapshot operations
+	Hooks HooksConfig `toml:"hooks"`
+
+	// Data or metadata usage of a pool, in percent, above which an event is
+	// published (If empty, the pools are not watched)
+	PoolThreshold float64 `toml:"pool_threshold"`
+
+	// How often the usage of the pools is checked against pool_threshold (If
+	// empty, 30s)
+	PoolCheckInterval string `toml:"pool_check_interval"`
+
+	// Concurrency limits of the LVM and mkfs commands
+	Scheduler SchedulerConfig `toml:"scheduler"`
 }
 
 // Validate all the necessary values exist and if not, the defaults are applied
@@ -78,5 +267,180 @@ func (c *SnapConfig) Validate(crootpath string) error {
 	if c.FsType == "" {
 		c.FsType = defaultFsType
 	}
+
+	switch c.PoolPolicy {
+	case "", PolicyMostFree, PolicyRoundRobin:
+	default:
+		return errors.Errorf("Unknown pool_policy %q", c.PoolPolicy)
+	}
+
+	names := map[string]bool{}
+	for i := range c.Pools {
+		p := &c.Pools[i]
+		if p.VgName == "" || p.ThinPool == "" {
+			return errors.Errorf("Need both vol_group and thin_pool to be set for pool %d", i)
+		}
+		p.VgName = strings.TrimSuffix(p.VgName, "/")
+		if p.Name == "" {
+			p.Name = poolName(p.VgName, p.ThinPool)
+		}
+		if names[p.Name] {
+			return errors.Errorf("Duplicate pool name %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	switch c.CrossPoolParent {
+	case "", CrossPoolClone, CrossPoolReject:
+	default:
+		return errors.Errorf("Unknown cross_pool_parent %q", c.CrossPoolParent)
+	}
+
+	switch c.MountMode {
+	case "", MountModeFilesystem, MountModeBlock:
+	default:
+		return errors.Errorf("Unknown mount_mode %q", c.MountMode)
+	}
+
+	switch c.BusyPolicy {
+	case "", BusyFail, BusyFreeze, BusyLazyUnmount:
+	default:
+		return errors.Errorf("Unknown busy_policy %q", c.BusyPolicy)
+	}
+
+	switch c.WipePolicy {
+	case "", WipeZero, WipeOverwrite, WipeCryptoErase:
+	default:
+		return errors.Errorf("Unknown wipe_policy %q", c.WipePolicy)
+	}
+
+	switch c.Encryption.KeyProvider {
+	case "", KeyProviderFile:
+	case KeyProviderCommand:
+		if c.Encryption.KeyCommand == "" {
+			return errors.New("Need key_command to be set for the command key provider")
+		}
+	default:
+		return errors.Errorf("Unknown key_provider %q", c.Encryption.KeyProvider)
+	}
+
+	for phase, hooks := range map[string][]HookConfig{"pre": c.Hooks.Pre, "post": c.Hooks.Post} {
+		for i := range hooks {
+			if err := hooks[i].validate(); err != nil {
+				return errors.Wrapf(err, "Invalid %s hook %d", phase, i)
+			}
+		}
+	}
+
+	if c.PoolThreshold < 0 || c.PoolThreshold > 100 {
+		return errors.Errorf("Invalid pool_threshold %v, expected a percentage", c.PoolThreshold)
+	}
+	if c.PoolThreshold > 0 {
+		if c.PoolCheckInterval == "" {
+			c.PoolCheckInterval = defaultPoolCheckInterval
+		}
+		if d, err := time.ParseDuration(c.PoolCheckInterval); err != nil || d <= 0 {
+			return errors.Errorf("Invalid pool_check_interval %q", c.PoolCheckInterval)
+		}
+	}
+
+	if c.Scheduler.LVMConcurrency < 0 || c.Scheduler.MkfsConcurrency < 0 {
+		return errors.New("Need lvm_concurrency and mkfs_concurrency to be positive")
+	}
+	if c.Scheduler.LVMConcurrency == 0 {
+		c.Scheduler.LVMConcurrency = defaultLVMConcurrency
+	}
+	if c.Scheduler.MkfsConcurrency == 0 {
+		c.Scheduler.MkfsConcurrency = defaultMkfsConcurrency
+	}
+
+	known := map[string]bool{}
+	for _, p := range c.AllPools() {
+		known[p.Name] = true
+	}
+	if c.DefaultPool != "" && !known[c.DefaultPool] {
+		return errors.Errorf("Unknown default_pool %q", c.DefaultPool)
+	}
+	for _, n := range c.Namespaces {
+		if n.Namespace == "" {
+			return errors.New("Need namespace to be set for every namespace mapping")
+		}
+		if !known[n.Pool] {
+			return errors.Errorf("Unknown pool %q for namespace %q", n.Pool, n.Namespace)
+		}
+	}
+	return nil
+}
+
+// NamespacePool returns the name of the pool volumes of the namespace are
+// placed in. The boolean is false when no namespace mapping is configured, in
+// which case the placement policy decides. Exact names take precedence over
+// prefixes, and longer prefixes over shorter ones.
+func (c *SnapConfig) NamespacePool(namespace string) (string, bool) {
+	if len(c.Namespaces) == 0 && c.DefaultPool == "" {
+		return "", false
+	}
+
+	pool, matched := "", -1
+	for _, n := range c.Namespaces {
+		if n.Namespace == namespace {
+			return n.Pool, true
+		}
+		prefix := strings.TrimSuffix(n.Namespace, "*")
+		if prefix != n.Namespace && strings.HasPrefix(namespace, prefix) && len(prefix) > matched {
+			pool, matched = n.Pool, len(prefix)
+		}
+	}
+	if matched >= 0 {
+		return pool, true
+	}
+	if c.DefaultPool != "" {
+		return c.DefaultPool, true
+	}
+	return c.AllPools()[0].Name, true
+}
+
+// AllPools returns every pool the snapshotter can place volumes in. The pool
+// named by vol_group and thin_pool always comes first as it holds the
+// metadata volume.
+func (c *SnapConfig) AllPools() []PoolConfig {
+	primary := PoolConfig{
+		Name:     poolName(c.VgName, c.ThinPool),
+		VgName:   c.VgName,
+		ThinPool: c.ThinPool,
+	}
+	pools := []PoolConfig{primary}
+	for _, p := range c.Pools {
+		if p.VgName == primary.VgName && p.ThinPool == primary.ThinPool {
+			// Allow the primary pool to be named and tiered in the pools list
+			pools[0] = p
+			continue
+		}
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+func poolName(vgname, lvpoolname string) string {
+	return fmt.Sprintf("%s/%s", vgname, lvpoolname)
+}
+
+func (h *HookConfig) validate() error {
+	if h.Path == "" {
+		return errors.New("Need path to be set")
+	}
+	for _, op := range h.Operations {
+		switch op {
+		case HookPrepare, HookView, HookCommit, HookRemove:
+		default:
+			return errors.Errorf("Unknown operation %q", op)
+		}
+	}
+	if h.Timeout == "" {
+		h.Timeout = defaultHookTimeout
+	}
+	if d, err := time.ParseDuration(h.Timeout); err != nil || d <= 0 {
+		return errors.Errorf("Invalid timeout %q", h.Timeout)
+	}
 	return nil
 }
@@ -40,13 +40,14 @@ func TestValidateConfig(t *testing.T) {
 		ImageSize: "10G",
 		FsType:    "xfs",
 		RootPath:  "/mnt",
+		Scheduler: SchedulerConfig{LVMConcurrency: 4, MkfsConcurrency: 2},
 	}
 
 	c.VgName = "test_vg"
 	c.ThinPool = "test_pool"
 	err = c.Validate("")
 	assert.NilError(t, err)
-	assert.Equal(t, c, expected)
+	assert.DeepEqual(t, c, expected)
 
 	c = SnapConfig{
 		VgName:   "test_vg",
@@ -59,9 +60,201 @@ func TestValidateConfig(t *testing.T) {
 		ImageSize: "10G",
 		FsType:    "xfs",
 		RootPath:  rootpath,
+		Scheduler: SchedulerConfig{LVMConcurrency: 4, MkfsConcurrency: 2},
 	}
 
 	err = c.Validate(rootpath)
 	assert.NilError(t, err)
-	assert.Equal(t, c, expected)
+	assert.DeepEqual(t, c, expected)
+}
+
+func TestValidatePools(t *testing.T) {
+	c := SnapConfig{
+		VgName:   "test_vg/",
+		ThinPool: "test_pool",
+		Pools: []PoolConfig{
+			{VgName: "fast_vg/", ThinPool: "fast_pool", Tier: "ssd"},
+			{Name: "primary", VgName: "test_vg", ThinPool: "test_pool", Tier: "hdd"},
+		},
+	}
+	err := c.Validate("")
+	assert.NilError(t, err)
+
+	expected := []PoolConfig{
+		{Name: "primary", VgName: "test_vg", ThinPool: "test_pool", Tier: "hdd"},
+		{Name: "fast_vg/fast_pool", VgName: "fast_vg", ThinPool: "fast_pool", Tier: "ssd"},
+	}
+	assert.DeepEqual(t, c.AllPools(), expected)
+
+	c.Pools = append(c.Pools, PoolConfig{VgName: "fast_vg", ThinPool: "fast_pool"})
+	err = c.Validate("")
+	assert.Error(t, err, "Duplicate pool name \"fast_vg/fast_pool\"")
+
+	c.Pools = []PoolConfig{{VgName: "fast_vg"}}
+	err = c.Validate("")
+	assert.Error(t, err, "Need both vol_group and thin_pool to be set for pool 0")
+
+	c.Pools = nil
+	c.PoolPolicy = "random"
+	err = c.Validate("")
+	assert.Error(t, err, "Unknown pool_policy \"random\"")
+}
+
+func TestNamespacePool(t *testing.T) {
+	c := SnapConfig{
+		VgName:   "test_vg",
+		ThinPool: "test_pool",
+		Pools: []PoolConfig{
+			{Name: "tenant", VgName: "tenant_vg", ThinPool: "tenant_pool"},
+			{Name: "team", VgName: "team_vg", ThinPool: "team_pool"},
+		},
+	}
+	err := c.Validate("")
+	assert.NilError(t, err)
+
+	_, ok := c.NamespacePool("default")
+	assert.Assert(t, !ok)
+
+	c.Namespaces = []NamespacePool{
+		{Namespace: "tenant-*", Pool: "tenant"},
+		{Namespace: "tenant-team*", Pool: "team"},
+		{Namespace: "tenant-teamx", Pool: "test_vg/test_pool"},
+	}
+	err = c.Validate("")
+	assert.NilError(t, err)
+
+	for ns, expected := range map[string]string{
+		"tenant-a":     "tenant",
+		"tenant-team1": "team",
+		"tenant-teamx": "test_vg/test_pool",
+		"default":      "test_vg/test_pool",
+	} {
+		pool, ok := c.NamespacePool(ns)
+		assert.Assert(t, ok)
+		assert.Equal(t, pool, expected, ns)
+	}
+
+	c.DefaultPool = "team"
+	pool, _ := c.NamespacePool("default")
+	assert.Equal(t, pool, "team")
+
+	c.DefaultPool = "missing"
+	err = c.Validate("")
+	assert.Error(t, err, "Unknown default_pool \"missing\"")
+
+	c.DefaultPool = ""
+	c.Namespaces = append(c.Namespaces, NamespacePool{Namespace: "k8s.io", Pool: "missing"})
+	err = c.Validate("")
+	assert.Error(t, err, "Unknown pool \"missing\" for namespace \"k8s.io\"")
+
+	c.Namespaces = nil
+	c.CrossPoolParent = "share"
+	err = c.Validate("")
+	assert.Error(t, err, "Unknown cross_pool_parent \"share\"")
+}
+
+func TestValidateEncryption(t *testing.T) {
+	c := SnapConfig{
+		VgName:   "test_vg",
+		ThinPool: "test_pool",
+		Encryption: EncryptionConfig{
+			KeyProvider: KeyProviderCommand,
+		},
+	}
+	err := c.Validate("")
+	assert.Error(t, err, "Need key_command to be set for the command key provider")
+
+	c.Encryption.KeyCommand = "/usr/local/bin/keys"
+	assert.NilError(t, c.Validate(""))
+
+	c.Encryption.KeyProvider = "vault"
+	err = c.Validate("")
+	assert.Error(t, err, "Unknown key_provider \"vault\"")
+}
+
+func TestValidateMountMode(t *testing.T) {
+	c := SnapConfig{
+		VgName:    "test_vg",
+		ThinPool:  "test_pool",
+		MountMode: MountModeBlock,
+	}
+	assert.NilError(t, c.Validate(""))
+
+	c.MountMode = "raw"
+	err := c.Validate("")
+	assert.Error(t, err, "Unknown mount_mode \"raw\"")
+}
+
+func TestValidateWipePolicy(t *testing.T) {
+	c := SnapConfig{
+		VgName:     "test_vg",
+		ThinPool:   "test_pool",
+		WipePolicy: WipeCryptoErase,
+	}
+	assert.NilError(t, c.Validate(""))
+
+	c.WipePolicy = "shred"
+	err := c.Validate("")
+	assert.Error(t, err, "Unknown wipe_policy \"shred\"")
+}
+
+func TestValidateBusyPolicy(t *testing.T) {
+	c := SnapConfig{
+		VgName:     "test_vg",
+		ThinPool:   "test_pool",
+		BusyPolicy: BusyLazyUnmount,
+	}
+	assert.NilError(t, c.Validate(""))
+
+	c.BusyPolicy = "kill"
+	err := c.Validate("")
+	assert.Error(t, err, "Unknown busy_policy \"kill\"")
+}
+
+func TestValidateHooks(t *testing.T) {
+	c := SnapConfig{
+		VgName:   "test_vg",
+		ThinPool: "test_pool",
+		Hooks: HooksConfig{
+			Post: []HookConfig{{Path: "/usr/local/bin/inventory"}},
+		},
+	}
+	assert.NilError(t, c.Validate(""))
+	assert.Equal(t, c.Hooks.Post[0].Timeout, defaultHookTimeout)
+
+	c.Hooks.Post[0].Operations = []string{"checkpoint"}
+	assert.Error(t, c.Validate(""), "Invalid post hook 0: Unknown operation \"checkpoint\"")
+
+	c.Hooks.Post[0] = HookConfig{}
+	assert.Error(t, c.Validate(""), "Invalid post hook 0: Need path to be set")
+}
+
+func TestValidatePoolThreshold(t *testing.T) {
+	c := SnapConfig{
+		VgName:        "test_vg",
+		ThinPool:      "test_pool",
+		PoolThreshold: 80,
+	}
+	assert.NilError(t, c.Validate(""))
+	assert.Equal(t, c.PoolCheckInterval, defaultPoolCheckInterval)
+
+	c.PoolCheckInterval = "soon"
+	assert.Error(t, c.Validate(""), "Invalid pool_check_interval \"soon\"")
+
+	c.PoolCheckInterval = ""
+	c.PoolThreshold = 120
+	assert.Error(t, c.Validate(""), "Invalid pool_threshold 120, expected a percentage")
+}
+
+func TestValidateScheduler(t *testing.T) {
+	c := SnapConfig{
+		VgName:    "test_vg",
+		ThinPool:  "test_pool",
+		Scheduler: SchedulerConfig{MkfsConcurrency: 8},
+	}
+	assert.NilError(t, c.Validate(""))
+	assert.DeepEqual(t, c.Scheduler, SchedulerConfig{LVMConcurrency: defaultLVMConcurrency, MkfsConcurrency: 8})
+
+	c.Scheduler.LVMConcurrency = -1
+	assert.Error(t, c.Validate(""), "Need lvm_concurrency and mkfs_concurrency to be positive")
 }
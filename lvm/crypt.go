@@ -0,0 +1,206 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LabelEncrypt turns encryption of a new base volume on or off,
+	// overriding the encryption setting of the configuration. Volumes created
+	// from a parent are always encrypted like their parent.
+	LabelEncrypt = "containerd.io/snapshot/lvm.encrypt"
+
+	keySize       = 64
+	defaultKeyDir = "keys"
+)
+
+// keyProvider hands out the keys used to encrypt volumes. Keys are identified
+// by the ID of the base volume they were created for, as all the thin
+// snapshots of a volume share its LUKS header.
+type keyProvider interface {
+	create(id string) ([]byte, error)
+	get(id string) ([]byte, error)
+	delete(id string) error
+}
+
+func newKeyProvider(c EncryptionConfig, root string) keyProvider {
+	switch c.KeyProvider {
+	case KeyProviderCommand:
+		return &commandKeys{command: c.KeyCommand}
+	default:
+		dir := c.KeyDir
+		if dir == "" {
+			dir = filepath.Join(root, defaultKeyDir)
+		}
+		return &fileKeys{dir: dir}
+	}
+}
+
+// fileKeys stores a randomly generated key per volume in a local directory
+type fileKeys struct {
+	dir string
+}
+
+func (f *fileKeys) path(id string) string {
+	return filepath.Join(f.dir, id+".key")
+}
+
+func (f *fileKeys) create(id string) ([]byte, error) {
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "Unable to create key directory")
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "Unable to generate key")
+	}
+	if err := ioutil.WriteFile(f.path(id), key, 0600); err != nil {
+		return nil, errors.Wrapf(err, "Unable to store key %s", id)
+	}
+	return key, nil
+}
+
+func (f *fileKeys) get(id string) ([]byte, error) {
+	key, err := ioutil.ReadFile(f.path(id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read key %s", id)
+	}
+	return key, nil
+}
+
+func (f *fileKeys) delete(id string) error {
+	if err := os.Remove(f.path(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Unable to delete key %s", id)
+	}
+	return nil
+}
+
+// commandKeys delegates key management to an external command. It is invoked
+// as "<command> create|get|delete <id>" and has to print the key on standard
+// output for create and get.
+type commandKeys struct {
+	command string
+}
+
+func (c *commandKeys) run(action string, id string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.command, action, id)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "key command failed to %s key %s: %s", action, id, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+func (c *commandKeys) create(id string) ([]byte, error) {
+	return c.nonEmpty(c.run("create", id))
+}
+
+func (c *commandKeys) get(id string) ([]byte, error) {
+	return c.nonEmpty(c.run("get", id))
+}
+
+func (c *commandKeys) delete(id string) error {
+	_, err := c.run("delete", id)
+	return err
+}
+
+func (c *commandKeys) nonEmpty(key []byte, err error) ([]byte, error) {
+	if err == nil && len(key) == 0 {
+		err = errors.New("key command returned an empty key")
+	}
+	return key, err
+}
+
+// cryptName returns the device mapper name of the crypt mapping of a volume.
+// The volume group is part of it as snapshot IDs are only unique within a
+// single snapshotter.
+func cryptName(vgname string, lvname string) string {
+	return vgname + "-" + lvname + "-crypt"
+}
+
+func cryptDevice(vgname string, lvname string) string {
+	return filepath.Join("/dev/mapper", cryptName(vgname, lvname))
+}
+
+func luksFormat(ctx context.Context, vgname string, lvname string, key []byte) (string, error) {
+	cmd := "cryptsetup"
+	args := []string{"luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-", filepath.Join("/dev", vgname, lvname)}
+	return runCommandWithInput(ctx, cmd, args, key)
+}
+
+// openCrypt opens the crypt mapping of the volume. dm-crypt drops discards
+// unless allowDiscards is set.
+func openCrypt(ctx context.Context, vgname string, lvname string, key []byte, allowDiscards bool) (string, error) {
+	if _, err := os.Stat(cryptDevice(vgname, lvname)); err == nil {
+		return "", nil
+	}
+	cmd := "cryptsetup"
+	args := []string{"open", "--type", "luks2", "--key-file", "-"}
+	if allowDiscards {
+		args = append(args, "--allow-discards")
+	}
+	args = append(args, filepath.Join("/dev", vgname, lvname), cryptName(vgname, lvname))
+	return runCommandWithInput(ctx, cmd, args, key)
+}
+
+func closeCrypt(ctx context.Context, vgname string, lvname string) (string, error) {
+	cmd := "cryptsetup"
+	args := []string{"close", cryptName(vgname, lvname)}
+	var re = regexp.MustCompile(`not active|doesn't exist`)
+
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil && re.MatchString(output) {
+		return output, nil
+	}
+	return output, err
+}
+
+// resizeCrypt grows the crypt mapping to the size of the underlying volume.
+// LUKS2 keeps the volume key in the kernel keyring, so the key is required.
+func resizeCrypt(ctx context.Context, vgname string, lvname string, key []byte) (string, error) {
+	cmd := "cryptsetup"
+	args := []string{"resize", "--key-file", "-", cryptName(vgname, lvname)}
+	return runCommandWithInput(ctx, cmd, args, key)
+}
+
+// encryptionRequested tells whether a new base volume has to be encrypted
+func encryptionRequested(c EncryptionConfig, labels map[string]string) (bool, error) {
+	v, ok := labels[LabelEncrypt]
+	if !ok {
+		return c.Enabled, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid value for label %s", LabelEncrypt)
+	}
+	return enabled, nil
+}
@@ -0,0 +1,115 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestFileKeys(t *testing.T) {
+	root, err := ioutil.TempDir("", "lvm-keys")
+	assert.NilError(t, err)
+	defer os.RemoveAll(root)
+
+	keys := newKeyProvider(EncryptionConfig{}, root)
+	key, err := keys.create("1")
+	assert.NilError(t, err)
+	assert.Equal(t, len(key), keySize)
+
+	fi, err := os.Stat(filepath.Join(root, defaultKeyDir, "1.key"))
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0600))
+
+	got, err := keys.get("1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, key)
+
+	assert.NilError(t, keys.delete("1"))
+	assert.NilError(t, keys.delete("1"))
+	_, err = keys.get("1")
+	assert.ErrorContains(t, err, "Unable to read key 1")
+}
+
+func TestCommandKeys(t *testing.T) {
+	root, err := ioutil.TempDir("", "lvm-keys")
+	assert.NilError(t, err)
+	defer os.RemoveAll(root)
+
+	script := filepath.Join(root, "keys.sh")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+create|get) printf "secret-$2" ;;
+delete) exit 0 ;;
+*) echo "bad action" >&2; exit 1 ;;
+esac
+`), 0700)
+	assert.NilError(t, err)
+
+	keys := newKeyProvider(EncryptionConfig{KeyProvider: KeyProviderCommand, KeyCommand: script}, root)
+	key, err := keys.create("7")
+	assert.NilError(t, err)
+	assert.Equal(t, string(key), "secret-7")
+
+	key, err = keys.get("7")
+	assert.NilError(t, err)
+	assert.Equal(t, string(key), "secret-7")
+	assert.NilError(t, keys.delete("7"))
+
+	c := &commandKeys{command: script}
+	_, err = c.run("rotate", "7")
+	assert.ErrorContains(t, err, "bad action")
+}
+
+func TestEncryptionRequested(t *testing.T) {
+	enabled, err := encryptionRequested(EncryptionConfig{}, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, !enabled)
+
+	enabled, err = encryptionRequested(EncryptionConfig{Enabled: true}, map[string]string{})
+	assert.NilError(t, err)
+	assert.Assert(t, enabled)
+
+	enabled, err = encryptionRequested(EncryptionConfig{Enabled: true}, map[string]string{LabelEncrypt: "false"})
+	assert.NilError(t, err)
+	assert.Assert(t, !enabled)
+
+	enabled, err = encryptionRequested(EncryptionConfig{}, map[string]string{LabelEncrypt: "true"})
+	assert.NilError(t, err)
+	assert.Assert(t, enabled)
+
+	_, err = encryptionRequested(EncryptionConfig{}, map[string]string{LabelEncrypt: "maybe"})
+	assert.ErrorContains(t, err, "invalid value for label")
+}
+
+func TestEncryptedDiscards(t *testing.T) {
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		assert.NilError(t, prepare("plain")(ctx, o))
+		assert.Assert(t, contains(f.calls, "cryptsetup open --type luks2 --key-file - /dev/vg/1 vg-1-crypt"), f.calls)
+
+		o.config.Discard.Mount = true
+		assert.NilError(t, prepare("discard")(ctx, o))
+		assert.Assert(t, contains(f.calls, "cryptsetup open --type luks2 --key-file - --allow-discards /dev/vg/2 vg-2-crypt"), f.calls)
+	})
+}
@@ -0,0 +1,295 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+// Types of the lifecycle events
+const (
+	EventCreated    = "created"
+	EventCommitted  = "committed"
+	EventRemoved    = "removed"
+	EventResized    = "resized"
+	EventPoolFull   = "pool-threshold-crossed"
+	EventReconciled = "reconciliation-fixed"
+)
+
+// Fixes reported by reconciliation events
+const (
+	FixOrphanVolume = "orphan-volume"
+	FixStaleRecord  = "stale-record"
+)
+
+// eventBuffer is the number of events a subscriber may fall behind before it
+// is dropped
+const eventBuffer = 128
+
+// Event is a lifecycle change of a snapshot or a pool. Snapshot events carry
+// the Info of the snapshot, pool and reconciliation events have no namespace.
+type Event struct {
+	Type      string
+	Timestamp time.Time
+	Namespace string
+	Info      snapshots.Info
+
+	// ID of the snapshot, or the logical volume or record a reconciliation
+	// fixed
+	ID   string
+	Pool string
+
+	// Size is the new size in bytes of a resized snapshot
+	Size uint64
+
+	// Usage of a pool that crossed the threshold, Above tells in which
+	// direction
+	DataPercent     float64
+	MetadataPercent float64
+	Threshold       float64
+	Above           bool
+
+	// Fix is what reconciliation did, either orphan-volume or stale-record
+	Fix string
+}
+
+type subscriber struct {
+	namespaces map[string]bool
+	ch         chan Event
+	errs       chan error
+}
+
+// wants tells whether the event is of interest to the subscriber
+func (s *subscriber) wants(ev Event) bool {
+	return ev.Namespace == "" || len(s.namespaces) == 0 || s.namespaces[ev.Namespace]
+}
+
+// eventBroker fans the events out to the subscribers. Publishing never blocks
+// the snapshot operations, subscribers that fall behind are dropped.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: map[*subscriber]struct{}{}}
+}
+
+// subscribe returns the events of the namespaces, all of them when none are
+// given. The channel is closed once the context is done or the subscriber was
+// dropped, the error channel then tells why.
+func (b *eventBroker) subscribe(ctx context.Context, nss []string) (<-chan Event, <-chan error) {
+	s := &subscriber{
+		ch:   make(chan Event, eventBuffer),
+		errs: make(chan error, 1),
+	}
+	if len(nss) > 0 {
+		s.namespaces = map[string]bool{}
+		for _, ns := range nss {
+			s.namespaces[ns] = true
+		}
+	}
+
+	b.mu.Lock()
+	b.subscribers[s] = struct{}{}
+	if b.closed {
+		b.drop(s, errClosedBroker)
+	}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		b.drop(s, ctx.Err())
+		b.mu.Unlock()
+	}()
+	return s.ch, s.errs
+}
+
+// drop removes the subscriber, the caller holds the lock
+func (b *eventBroker) drop(s *subscriber, err error) {
+	if _, ok := b.subscribers[s]; !ok {
+		return
+	}
+	delete(b.subscribers, s)
+	s.errs <- err
+	close(s.errs)
+	close(s.ch)
+}
+
+// errClosedBroker ends the subscriptions of a snapshotter shutting down
+var errClosedBroker = errors.Wrap(errdefs.ErrUnavailable, "snapshotter is shutting down")
+
+// close drops every subscriber and refuses new ones. Subscriptions otherwise
+// only end with their clients, which would keep a graceful stop of the
+// server waiting.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subscribers {
+		b.drop(s, errClosedBroker)
+	}
+}
+
+// active tells whether anybody listens, which saves describing snapshots
+// nobody asked about
+func (b *eventBroker) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) > 0
+}
+
+func (b *eventBroker) publish(ev Event) {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		if !s.wants(ev) {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			b.drop(s, errors.Wrap(errdefs.ErrUnavailable, "subscriber fell behind, events were dropped"))
+		}
+	}
+}
+
+// Subscribe returns the lifecycle events of the snapshots of the namespaces,
+// or of all snapshots when none are given, along with all pool and
+// reconciliation events.
+func (o *snapshotter) Subscribe(ctx context.Context, namespaces ...string) (<-chan Event, <-chan error) {
+	return o.events.subscribe(ctx, namespaces)
+}
+
+// CloseEvents ends every subscription with ErrUnavailable and refuses new
+// ones.
+func (o *snapshotter) CloseEvents() {
+	o.events.close()
+}
+
+// snapshotRecord is what hooks and events are told about an existing snapshot
+type snapshotRecord struct {
+	id   string
+	info snapshots.Info
+	vol  volume
+}
+
+func (o *snapshotter) describe(ctx context.Context, key string) (_ snapshotRecord, err error) {
+	ctx, t, err := o.transaction(ctx, false)
+	if err != nil {
+		return snapshotRecord{}, err
+	}
+	defer func() {
+		if rerr := t.Rollback(); rerr != nil {
+			log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+		}
+	}()
+
+	id, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return snapshotRecord{}, err
+	}
+	vol, err := o.volume(t, id)
+	if err != nil {
+		return snapshotRecord{}, err
+	}
+	return snapshotRecord{id: id, info: info, vol: vol}, nil
+}
+
+// notify publishes the event about the snapshot key when anybody listens
+func (o *snapshotter) notify(ctx context.Context, ev Event, key string) {
+	if !o.events.active() {
+		return
+	}
+	r, err := o.describe(ctx, key)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("Unable to describe snapshot to the %s event", ev.Type)
+		return
+	}
+	o.publishSnapshotEvent(ctx, ev, r)
+}
+
+func (o *snapshotter) publishSnapshotEvent(ctx context.Context, ev Event, r snapshotRecord) {
+	ev.Namespace, _ = namespaces.Namespace(ctx)
+	ev.Info = r.info
+	ev.ID = r.id
+	ev.Pool = r.vol.Pool
+	o.events.publish(ev)
+}
+
+// watchPools publishes an event whenever the data or metadata usage of a pool
+// crosses the threshold, in either direction, until the context is done
+func (o *snapshotter) watchPools(ctx context.Context, threshold float64, interval time.Duration) {
+	above := map[string]bool{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		o.checkPools(ctx, threshold, above)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *snapshotter) checkPools(ctx context.Context, threshold float64, above map[string]bool) {
+	status, err := o.PoolStatus(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("Unable to check the usage of the pools")
+		return
+	}
+	for _, p := range status {
+		if p.Error != "" {
+			continue
+		}
+		full := p.DataPercent >= threshold || p.MetadataPercent >= threshold
+		if full == above[p.Name] {
+			continue
+		}
+		above[p.Name] = full
+		if full {
+			log.G(ctx).Warnf("Pool %s is above %.1f%%, data %.1f%%, metadata %.1f%%", p.Name, threshold, p.DataPercent, p.MetadataPercent)
+		} else {
+			log.G(ctx).Infof("Pool %s is back below %.1f%%", p.Name, threshold)
+		}
+		o.events.publish(Event{
+			Type:            EventPoolFull,
+			Pool:            p.Name,
+			DataPercent:     p.DataPercent,
+			MetadataPercent: p.MetadataPercent,
+			Threshold:       threshold,
+			Above:           full,
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"gotest.tools/assert"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := newEventBroker()
+	assert.Assert(t, !b.active())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	all, allErrs := b.subscribe(ctx, nil)
+	k8s, _ := b.subscribe(context.Background(), []string{"k8s.io"})
+	assert.Assert(t, b.active())
+
+	b.publish(Event{Type: EventCreated, Namespace: "default", ID: "1"})
+	b.publish(Event{Type: EventCreated, Namespace: "k8s.io", ID: "2"})
+	b.publish(Event{Type: EventPoolFull, Pool: "vg/pool", Above: true})
+
+	var ids []string
+	for _, ch := range []<-chan Event{all, all, all, k8s, k8s} {
+		ev := <-ch
+		assert.Assert(t, !ev.Timestamp.IsZero())
+		ids = append(ids, ev.ID+ev.Pool)
+	}
+	assert.DeepEqual(t, ids, []string{"1", "2", "vg/pool", "2", "vg/pool"})
+
+	cancel()
+	_, ok := <-all
+	assert.Assert(t, !ok)
+	assert.Equal(t, <-allErrs, context.Canceled)
+}
+
+func TestEventBrokerDropsSlowSubscribers(t *testing.T) {
+	b := newEventBroker()
+	ch, errs := b.subscribe(context.Background(), nil)
+
+	for i := 0; i <= eventBuffer; i++ {
+		b.publish(Event{Type: EventRemoved, Namespace: "default"})
+	}
+	assert.Assert(t, !b.active())
+
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.Equal(t, n, eventBuffer)
+	assert.Assert(t, errdefs.IsUnavailable(<-errs))
+}
+
+func TestEventBrokerClose(t *testing.T) {
+	b := newEventBroker()
+	ch, errs := b.subscribe(context.Background(), nil)
+
+	b.close()
+	_, ok := <-ch
+	assert.Assert(t, !ok)
+	assert.Assert(t, errdefs.IsUnavailable(<-errs))
+
+	// Subscriptions after the broker was closed end right away
+	ch, errs = b.subscribe(context.Background(), nil)
+	_, ok = <-ch
+	assert.Assert(t, !ok)
+	assert.Assert(t, errdefs.IsUnavailable(<-errs))
+	assert.Assert(t, !b.active())
+}
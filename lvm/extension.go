@@ -0,0 +1,611 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sys/unix"
+)
+
+// DeviceInfo describes the device backing a snapshot
+type DeviceInfo struct {
+	// Pool, VgName and LVName locate the logical volume. Views of protected
+	// snapshots are served from the volume of the snapshot they view.
+	Pool   string
+	VgName string
+	LVName string
+
+	// Device is the path of the device the mounts of the snapshot use and
+	// DMDevice the device mapper node it resolves to
+	Device   string
+	DMDevice string
+	Major    uint32
+	Minor    uint32
+
+	// FsUUID is the UUID of the filesystem on the device
+	FsUUID string
+
+	// Size is the virtual size of the logical volume in bytes
+	Size uint64
+
+	Active         bool
+	Encrypted      bool
+	Block          bool
+	VerityRootHash string
+}
+
+// PoolStatus describes the state of a thin pool
+type PoolStatus struct {
+	Name     string
+	VgName   string
+	ThinPool string
+	Tier     string
+
+	// Size is the size of the data area of the pool in bytes
+	Size            uint64
+	DataPercent     float64
+	MetadataPercent float64
+
+	// Health is the health status reported by LVM, empty when the pool is
+	// healthy. Error is set when the pool could not be queried.
+	Health string
+	Error  string
+}
+
+// ReconcileReport lists the differences found between the metadata of the
+// snapshotter and the logical volumes of its pools
+type ReconcileReport struct {
+	// OrphanVolumes are logical volumes in the pools that are named like the
+	// volumes of the snapshotter but belong to no snapshot, as "vg/lv"
+	OrphanVolumes []string
+
+	// MissingVolumes are the keys of snapshots whose logical volume is gone
+	MissingVolumes []string
+
+	// StaleRecords are the IDs of volume records without a snapshot
+	StaleRecords []string
+
+	// Removed is set when orphan volumes and stale records were deleted
+	Removed bool
+}
+
+// DeviceInfo returns the details of the device backing the snapshot key
+func (o *snapshotter) DeviceInfo(ctx context.Context, key string) (_ DeviceInfo, err error) {
+	ctx, span := startSpan(ctx, "lvm.DeviceInfo", attribute.String("snapshot.key", key))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	ctx, t, err := o.transaction(ctx, false)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	defer func() {
+		if rerr := t.Rollback(); rerr != nil {
+			log.G(ctx).WithError(rerr).Warn("Failed to rollback transaction")
+		}
+	}()
+
+	s, err := storage.GetSnapshot(ctx, key)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	ctx = withSnapshotID(ctx, s.ID)
+	vol, err := o.volume(t, s.ID)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	if err := checkReady(vol, key); err != nil {
+		return DeviceInfo{}, err
+	}
+
+	info := DeviceInfo{
+		Pool:           vol.Pool,
+		VgName:         vol.VgName,
+		LVName:         s.ID,
+		Device:         o.getSnapshotDir(vol, s.ID),
+		Encrypted:      vol.Encrypted,
+		Block:          vol.Block,
+		VerityRootHash: vol.VerityHash,
+	}
+	if vol.VerityOf != "" {
+		info.LVName = vol.VerityOf
+	}
+	if info.Size, err = lvSize(ctx, vol.VgName, info.LVName); err != nil {
+		return DeviceInfo{}, err
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(info.Device, &st); err != nil {
+		if os.IsNotExist(err) {
+			return info, nil
+		}
+		return DeviceInfo{}, errors.Wrapf(err, "Unable to stat %s", info.Device)
+	}
+	info.Active = true
+	info.Major, info.Minor = unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+	if info.DMDevice, err = filepath.EvalSymlinks(info.Device); err != nil {
+		return DeviceInfo{}, errors.Wrapf(err, "Unable to resolve %s", info.Device)
+	}
+	if uuid, err := filesystemUUID(ctx, info.Device); err == nil {
+		info.FsUUID = uuid
+	} else {
+		log.G(ctx).WithError(err).Debugf("No filesystem UUID on %s", info.Device)
+	}
+	return info, nil
+}
+
+// PoolStatus returns the state of every pool of the snapshotter. Pools that
+// can not be queried are reported with an error instead of failing the call.
+func (o *snapshotter) PoolStatus(ctx context.Context) (_ []PoolStatus, err error) {
+	ctx, span := startSpan(ctx, "lvm.PoolStatus")
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, "")
+	var status []PoolStatus
+	for _, p := range o.pools {
+		ps := PoolStatus{
+			Name:     p.Name,
+			VgName:   p.VgName,
+			ThinPool: p.ThinPool,
+			Tier:     p.Tier,
+		}
+		u, err := poolStatus(ctx, p.VgName, p.ThinPool)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("Unable to query pool %s", p.Name)
+			ps.Error = err.Error()
+		} else {
+			ps.Size, ps.DataPercent, ps.MetadataPercent, ps.Health = u.size, u.dataPercent, u.metadataPercent, u.health
+		}
+		status = append(status, ps)
+	}
+	return status, nil
+}
+
+// Resize grows the volume of the active snapshot key and the filesystem on it
+// to size bytes. Volumes can not shrink.
+func (o *snapshotter) Resize(ctx context.Context, key string, size uint64) (err error) {
+	ctx, span := startSpan(ctx, "lvm.Resize", attribute.String("snapshot.key", key), attribute.Int64("snapshot.size", int64(size)))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	log.G(ctx).Debugf("Resize snapshot %s to %d bytes", key, size)
+	defer func() {
+		if err == nil {
+			o.notify(ctx, Event{Type: EventResized, Size: size}, key)
+		}
+	}()
+	_, unlock, err := o.lockSnapshot(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var (
+		s   storage.Snapshot
+		vol volume
+	)
+	if err = o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		var err error
+		if s, err = storage.GetSnapshot(ctx, key); err != nil {
+			return err
+		}
+		if s.Kind != snapshots.KindActive {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q is not active", key)
+		}
+		if vol, err = o.volume(t, s.ID); err != nil {
+			return err
+		}
+		return checkReady(vol, key)
+	}); err != nil {
+		return err
+	}
+	ctx = withSnapshotID(ctx, s.ID)
+	current, err := lvSize(ctx, vol.VgName, s.ID)
+	if err != nil {
+		return err
+	}
+	if size <= current {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "snapshot %q is already %d bytes, volumes can only grow", key, current)
+	}
+
+	if err = o.recordIntent(ctx, s.ID, intent{Op: intentResize, Key: key, Size: size, Volume: vol}); err != nil {
+		return err
+	}
+	// The volume may have grown already, a failed resize is completed by
+	// the recovery of its intent
+	if err = o.growVolume(ctx, s, vol, size); err != nil {
+		return err
+	}
+	o.clearIntent(ctx, s.ID)
+	return nil
+}
+
+// growVolume extends the volume of the active snapshot to size bytes unless
+// it is that large already, and grows the filesystem on it
+func (o *snapshotter) growVolume(ctx context.Context, s storage.Snapshot, vol volume, size uint64) error {
+	current, err := lvSize(ctx, vol.VgName, s.ID)
+	if err != nil {
+		return err
+	}
+	if current < size {
+		if out, err := extendLVMVolume(ctx, vol.VgName, s.ID, size); err != nil {
+			return errors.Wrapf(err, "Unable to extend volume: %s", out)
+		}
+	}
+	if err := o.activateVolume(ctx, vol, s.ID); err != nil {
+		return errors.Wrap(err, "Unable to activate volume")
+	}
+	if vol.Encrypted {
+		cryptKey, err := o.keys.get(vol.KeyID)
+		if err != nil {
+			return err
+		}
+		if out, err := resizeCrypt(ctx, vol.VgName, s.ID, cryptKey); err != nil {
+			return errors.Wrapf(err, "Unable to resize encrypted volume: %s", out)
+		}
+	}
+
+	device := o.getSnapshotDir(vol, s.ID)
+	mountpoints, err := deviceMounts(device)
+	if err != nil {
+		return err
+	}
+	if len(mountpoints) > 0 {
+		if out, err := growFilesystem(ctx, device, mountpoints[0], o.config.FsType); err != nil {
+			return errors.Wrapf(err, "Unable to grow filesystem: %s", out)
+		}
+		return nil
+	}
+	if vol.Block {
+		// The filesystem may be mounted inside a guest, which has to
+		// grow it.
+		return nil
+	}
+	return withTempMount(ctx, o.mounts(s, vol), func(root string) error {
+		if out, err := growFilesystem(ctx, device, root, o.config.FsType); err != nil {
+			return errors.Wrapf(err, "Unable to grow filesystem: %s", out)
+		}
+		return nil
+	})
+}
+
+// Reconcile compares the snapshots and volume records in the metadata with
+// the logical volumes in the pools. With remove set, orphan volumes and stale
+// records are deleted. Snapshots with missing volumes are only reported.
+// Volumes not named like the ones the snapshotter creates belong to other
+// users of the pools and are left out.
+func (o *snapshotter) Reconcile(ctx context.Context, remove bool) (_ ReconcileReport, err error) {
+	ctx, span := startSpan(ctx, "lvm.Reconcile", attribute.Bool("remove", remove))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, "")
+	log.G(ctx).Debugf("Reconcile called, remove: %t", remove)
+	return o.reconcile(ctx, remove, ownVolumeName)
+}
+
+// Cleanup is called by the garbage collector of containerd once it removed
+// snapshots. In the background of the other operations, it deletes stale
+// volume records and the orphan volumes named like the volumes of the
+// snapshotter, leaving the volumes of other users of the pools alone.
+func (o *snapshotter) Cleanup(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "lvm.Cleanup")
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, "")
+	ctx = withPriority(ctx, priorityBackground)
+	defer observeOperation("cleanup", time.Now(), &err)
+	report, err := o.reconcile(ctx, true, ownVolumeName)
+	if err != nil {
+		return err
+	}
+	if len(report.OrphanVolumes) > 0 || len(report.StaleRecords) > 0 {
+		log.G(ctx).Infof("Removed orphan volumes %v and stale records %v", report.OrphanVolumes, report.StaleRecords)
+	}
+	return nil
+}
+
+// ownVolumeName tells whether the logical volume is named like the ones the
+// snapshotter creates: a snapshot ID, possibly followed by the suffix of a
+// hash, reset, committed copy or detached volume
+func ownVolumeName(lvname string) bool {
+	_, err := strconv.ParseUint(volumeID(lvname), 10, 64)
+	return err == nil
+}
+
+// volumeID returns the ID of the snapshot a logical volume of the
+// snapshotter belongs to
+func volumeID(lvname string) string {
+	for _, suffix := range []string{hashLVName(""), resetLVName(""), commitLVName(""), detachedLVName("")} {
+		if strings.HasSuffix(lvname, suffix) {
+			return strings.TrimSuffix(lvname, suffix)
+		}
+	}
+	return lvname
+}
+
+// reconcile is Reconcile limited to the logical volumes the owned function
+// accepts. The metadata is read in a transaction of its own, the volumes are
+// listed and deleted outside of it, so the LVM commands waiting on the
+// scheduler never hold up writers. Orphans are checked again under their
+// lock before they are deleted, and stale records in the short transaction
+// deleting them.
+func (o *snapshotter) reconcile(ctx context.Context, remove bool, owned func(lvname string) bool) (_ ReconcileReport, err error) {
+	// Logical volumes every pool is expected to hold, and the keys of the
+	// snapshots they back
+	expected := map[string]map[string]string{}
+	expect := func(pool, lvname, key string) {
+		if expected[pool] == nil {
+			expected[pool] = map[string]string{}
+		}
+		expected[pool][lvname] = key
+	}
+	var (
+		ids     map[string]bool
+		pending map[string]intent
+		records []string
+	)
+	if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) (err error) {
+		ids = map[string]bool{}
+		if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+			id, _, _, err := storage.GetInfo(ctx, info.Name)
+			if err != nil {
+				return err
+			}
+			ids[id] = true
+			vol, err := o.volume(t, id)
+			if err != nil {
+				return err
+			}
+			if o.locks.busy(id) {
+				// The volumes of snapshots operations work on come and go
+				return nil
+			}
+			for _, lvname := range snapshotVolumes(vol, id) {
+				expect(vol.Pool, lvname, info.Name)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		// Volumes and records of interrupted operations are left to the
+		// recovery of the intent log
+		if pending, err = intents(t); err != nil {
+			return err
+		}
+		records, err = volumeIDs(t)
+		return err
+	}); err != nil {
+		return ReconcileReport{}, err
+	}
+	recovering := func(lvname string) bool {
+		id := volumeID(lvname)
+		if _, ok := pending[id]; ok {
+			return true
+		}
+		// The replacement of a reset belongs to its snapshot until it
+		// took its place
+		return lvname == resetLVName(id) && ids[id]
+	}
+
+	var report ReconcileReport
+	for _, p := range o.pools {
+		if p.VgName == o.config.VgName && p.ThinPool == o.config.ThinPool {
+			expect(p.Name, metavolume, "")
+		}
+		names, err := thinVolumes(ctx, p.VgName, p.ThinPool)
+		if err != nil {
+			return ReconcileReport{}, err
+		}
+		present := map[string]bool{}
+		for _, name := range names {
+			present[name] = true
+			if _, ok := expected[p.Name][name]; ok || !owned(name) || o.locks.busy(volumeID(name)) || recovering(name) {
+				continue
+			}
+			if strings.HasSuffix(name, detachedLVName("")) {
+				// Detached volumes stay around until they are unmounted
+				mounted, err := deviceMounts("/dev/" + p.VgName + "/" + name)
+				if err != nil {
+					return ReconcileReport{}, err
+				}
+				if len(mounted) > 0 {
+					continue
+				}
+			}
+			if !remove {
+				report.OrphanVolumes = append(report.OrphanVolumes, p.VgName+"/"+name)
+				continue
+			}
+			removed, err := o.removeUnowned(ctx, p.VgName, name)
+			if err != nil {
+				return ReconcileReport{}, err
+			}
+			if removed {
+				report.OrphanVolumes = append(report.OrphanVolumes, p.VgName+"/"+name)
+				o.events.publish(Event{Type: EventReconciled, Fix: FixOrphanVolume, Pool: p.Name, ID: name})
+			}
+		}
+		for name, key := range expected[p.Name] {
+			if !present[name] && key != "" {
+				report.MissingVolumes = append(report.MissingVolumes, key)
+			}
+		}
+	}
+
+	for _, id := range records {
+		if _, ok := pending[id]; !ok && !ids[id] && !o.locks.busy(id) {
+			report.StaleRecords = append(report.StaleRecords, id)
+		}
+	}
+	if remove && len(report.StaleRecords) > 0 {
+		var deleted []string
+		if err := o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+			current, err := storage.IDMap(ctx)
+			if err != nil {
+				return err
+			}
+			pending, err := intents(t)
+			if err != nil {
+				return err
+			}
+			deleted = nil
+			for _, id := range report.StaleRecords {
+				_, owned := current[id]
+				_, recovering := pending[id]
+				if owned || recovering || o.locks.busy(id) {
+					continue
+				}
+				if err := deleteVolume(t, id); err != nil {
+					return errors.Wrapf(err, "Unable to delete volume record %s", id)
+				}
+				deleted = append(deleted, id)
+			}
+			return nil
+		}); err != nil {
+			return ReconcileReport{}, err
+		}
+		report.StaleRecords = deleted
+	}
+
+	sort.Strings(report.MissingVolumes)
+	if remove {
+		report.Removed = true
+		for _, id := range report.StaleRecords {
+			o.events.publish(Event{Type: EventReconciled, Fix: FixStaleRecord, ID: id})
+		}
+	}
+	return report, nil
+}
+
+// snapshotVolumes returns the logical volumes backing the snapshot with the
+// given ID
+func snapshotVolumes(vol volume, id string) []string {
+	switch {
+	case vol.VerityOf != "":
+		// Verity views have no volume of their own
+		return nil
+	case vol.VerityHash != "":
+		return []string{id, hashLVName(id)}
+	default:
+		return []string{id}
+	}
+}
+
+// removeUnowned deletes an orphan volume unless a snapshot or an operation
+// claimed it since the metadata was read. The ID is locked meanwhile, which
+// keeps new operations from claiming it.
+func (o *snapshotter) removeUnowned(ctx context.Context, vgname string, lvname string) (bool, error) {
+	id := volumeID(lvname)
+	unlock, ok := o.locks.tryLock(id)
+	if !ok {
+		return false, nil
+	}
+	defer unlock()
+	var claimed bool
+	if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		pending, err := intents(t)
+		if err != nil {
+			return err
+		}
+		if _, claimed = pending[id]; claimed {
+			return nil
+		}
+		current, err := storage.IDMap(ctx)
+		if err != nil {
+			return err
+		}
+		if _, ok := current[id]; !ok {
+			return nil
+		}
+		vol, err := o.volume(t, id)
+		if err != nil {
+			return err
+		}
+		claimed = lvname == resetLVName(id)
+		for _, owned := range snapshotVolumes(vol, id) {
+			claimed = claimed || lvname == owned
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	if claimed {
+		return false, nil
+	}
+	if err := o.removeOrphan(ctx, vgname, lvname); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Check verifies that the volume groups and thin pools of the snapshotter are
+// still there and that its metadata volume is mounted
+func (o *snapshotter) Check(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "lvm.Check")
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, "")
+	for _, p := range o.pools {
+		if out, err := checkVG(ctx, p.VgName); err != nil {
+			return errors.Wrapf(err, "volume group %s is unavailable: %s", p.VgName, out)
+		}
+		if out, err := checkLV(ctx, p.VgName, p.ThinPool); err != nil {
+			return errors.Wrapf(err, "thin pool %s is unavailable: %s", p.Name, out)
+		}
+	}
+	mountpoints, err := deviceMounts(filepath.Join("/dev", o.config.VgName, metavolume))
+	if err != nil {
+		return err
+	}
+	for _, mp := range mountpoints {
+		if mp == o.metaVolPath {
+			return nil
+		}
+	}
+	return errors.Errorf("metadata volume is not mounted on %s", o.metaVolPath)
+}
+
+// removeOrphan tears down whatever may be stacked on a logical volume nobody
+// knows about anymore and deletes it
+func (o *snapshotter) removeOrphan(ctx context.Context, vgname string, lvname string) error {
+	log.G(ctx).Infof("Removing orphan volume %s/%s", vgname, lvname)
+	if out, err := verityClose(ctx, verityName(vgname, lvname)); err != nil {
+		log.G(ctx).WithError(err).Warnf("Unable to close verity device: %s", out)
+	}
+	if out, err := closeCrypt(ctx, vgname, lvname); err != nil {
+		log.G(ctx).WithError(err).Warnf("Unable to close encrypted volume: %s", out)
+	}
+	if err := unmountVolume(ctx, vgname, lvname); err != nil {
+		log.G(ctx).WithError(err).Warn("Unable to unmount volume")
+	}
+	if _, err := toggleactivateLV(ctx, vgname, lvname, false); err != nil {
+		log.G(ctx).WithError(err).Warn("Unable to deactivate volume")
+	}
+	if out, err := removeLVMVolume(ctx, vgname, lvname); err != nil {
+		return errors.Wrapf(err, "Unable to delete volume %s/%s: %s", vgname, lvname, out)
+	}
+	return nil
+}
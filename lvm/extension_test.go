@@ -0,0 +1,106 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/snapshots/storage"
+	"gotest.tools/assert"
+)
+
+func TestParsePoolStatus(t *testing.T) {
+	u, err := parsePoolStatus("  10737418240,12.50,3.20,\n")
+	assert.NilError(t, err)
+	assert.Equal(t, u, poolUsage{size: 10737418240, dataPercent: 12.5, metadataPercent: 3.2})
+
+	u, err = parsePoolStatus("  10737418240,100.00,3.20,out of data")
+	assert.NilError(t, err)
+	assert.Equal(t, u.health, "out of data")
+
+	_, err = parsePoolStatus("10737418240,12.50")
+	assert.ErrorContains(t, err, "Unexpected lvs output")
+}
+
+func TestParseThinVolumes(t *testing.T) {
+	output := `  contd-metadata-holder,lvthinpool
+  1,lvthinpool
+  1-verity,lvthinpool
+  lvthinpool,
+  other,otherpool`
+	assert.DeepEqual(t, parseThinVolumes(output, "lvthinpool"), []string{"contd-metadata-holder", "1", "1-verity"})
+	assert.Equal(t, len(parseThinVolumes(output, "missing")), 0)
+}
+
+func TestCountActiveThinVolumes(t *testing.T) {
+	output := `  contd-metadata-holder,lvthinpool,active
+  1,lvthinpool,active
+  2,lvthinpool,
+  lvthinpool,,active
+  3,otherpool,active`
+	assert.Equal(t, countActiveThinVolumes(output, "lvthinpool"), 2)
+}
+
+func TestOwnVolumeName(t *testing.T) {
+	for name, own := range map[string]bool{
+		"42":                    true,
+		"42-verity":             true,
+		"42-reset":              true,
+		"contd-metadata-holder": false,
+		"home":                  false,
+		"42-backup":             false,
+	} {
+		assert.Equal(t, ownVolumeName(name), own, name)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		assert.NilError(t, prepare("active")(ctx, o))
+		f.lvs["vg/7"] = true
+		f.lvs["vg/7-verity"] = true
+		f.lvs["vg/1-detached"] = true
+		f.lvs["vg/foreign"] = true
+		assert.NilError(t, o.withTransaction(ctx, true, func(ctx context.Context, tx storage.Transactor) error {
+			return putVolume(tx, "9", volume{Pool: "vg/pool", VgName: "vg", ThinPool: "pool"})
+		}))
+
+		// Writers go on while the volumes are listed
+		f.listed = func() {
+			done := make(chan error, 1)
+			go func() {
+				done <- o.withTransaction(ctx, true, func(ctx context.Context, tx storage.Transactor) error {
+					return nil
+				})
+			}()
+			select {
+			case err := <-done:
+				assert.NilError(t, err)
+			case <-time.After(10 * time.Second):
+				t.Error("metadata is locked while volumes are listed")
+			}
+		}
+		assert.NilError(t, o.Cleanup(ctx))
+		assert.DeepEqual(t, sorted(f.volumes()), []string{"vg/1", "vg/foreign"})
+		delete(f.lvs, "vg/foreign")
+		assertConsistent(ctx, t, o, f, "cleanup")
+	})
+}
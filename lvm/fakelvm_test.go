@@ -0,0 +1,263 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+)
+
+// fakeLVM stands in for the tools run by the snapshotter and for temporary
+// mounts. It keeps track of the logical volumes and their sizes and fails
+// every run of the command line in fail.
+type fakeLVM struct {
+	mu    sync.Mutex
+	lvs   map[string]bool
+	sizes map[string]string
+	root  string
+	calls []string
+	fail  string
+	// listed runs whenever the volumes of a group are listed
+	listed func()
+}
+
+func (f *fakeLVM) run(ctx context.Context, cmd string, args []string, input []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Temporary mount points differ from run to run
+	call := tempRoot.ReplaceAllString(strings.Join(append([]string{cmd}, args...), " "), "$$root")
+	if len(f.calls) == 0 || f.calls[len(f.calls)-1] != call {
+		f.calls = append(f.calls, call)
+	}
+	if call == f.fail {
+		return []byte("injected failure"), errors.New("exit status 5")
+	}
+	switch cmd {
+	case "lvcreate":
+		var name, vg string
+		for i, arg := range args[:len(args)-1] {
+			switch arg {
+			case "--name":
+				name = args[i+1]
+			case "--thin", "--snapshot":
+				vg = strings.Split(args[i+1], "/")[0]
+			}
+		}
+		f.lvs[vg+"/"+name] = true
+		f.sizes[vg+"/"+name] = "1073741824"
+	case "lvremove":
+		lv := args[len(args)-1]
+		if !f.lvs[lv] {
+			return []byte("Failed to find logical volume " + lv), errors.New("exit status 5")
+		}
+		delete(f.lvs, lv)
+	case "lvrename":
+		from, to := args[0]+"/"+args[1], args[0]+"/"+args[2]
+		if !f.lvs[from] || f.lvs[to] {
+			return []byte("Unable to rename " + from), errors.New("exit status 5")
+		}
+		delete(f.lvs, from)
+		f.lvs[to] = true
+		f.sizes[to] = f.sizes[from]
+	case "lvextend":
+		f.sizes[args[2]] = strings.TrimSuffix(args[1], "b")
+	case "veritysetup":
+		if args[0] == "format" {
+			return []byte("Root hash:      \t4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076"), nil
+		}
+	case "lvs":
+		if !strings.Contains(args[0], "/") {
+			if f.listed != nil {
+				f.listed()
+			}
+			// Every volume of the group lives in the pool
+			var out []string
+			for lv := range f.lvs {
+				if strings.HasPrefix(lv, args[0]+"/") {
+					out = append(out, strings.TrimPrefix(lv, args[0]+"/")+",pool")
+				}
+			}
+			return []byte(strings.Join(out, "\n")), nil
+		}
+		if args[0] == "vg/pool" && args[2] == "zero" {
+			return []byte("  zero"), nil
+		}
+		if !f.lvs[args[0]] {
+			return []byte("Failed to find logical volume " + args[0]), errors.New("exit status 5")
+		}
+		if args[2] == "lv_size" {
+			return []byte(f.sizes[args[0]]), nil
+		}
+		return []byte(filepath.Base(args[0])), nil
+	}
+	return nil, nil
+}
+
+var tempRoot = regexp.MustCompile(`/\S*/lvm-fake\d+/mount\d+`)
+
+// mount runs f on an empty directory in place of the volume
+func (f *fakeLVM) mount(ctx context.Context, mounts []mount.Mount, fn func(root string) error) error {
+	if _, err := f.run(ctx, "mount", []string{mounts[0].Source}, nil); err != nil {
+		return err
+	}
+	root, err := ioutil.TempDir(f.root, "mount")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	return fn(root)
+}
+
+func (f *fakeLVM) volumes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var lvs []string
+	for lv := range f.lvs {
+		lvs = append(lvs, lv)
+	}
+	return lvs
+}
+
+// withFakeLVM runs test against a snapshotter whose commands run on a fake
+func withFakeLVM(t *testing.T, test func(ctx context.Context, o *snapshotter, f *fakeLVM)) {
+	root, err := ioutil.TempDir("", "lvm-fake")
+	assert.NilError(t, err)
+	defer os.RemoveAll(root)
+
+	f := &fakeLVM{lvs: map[string]bool{}, sizes: map[string]string{}, root: root}
+	defer func(r commandRunner) { runner = r }(runner)
+	runner = f.run
+	defer func(m func(context.Context, []mount.Mount, func(string) error) error) { tempMount = m }(tempMount)
+	tempMount = f.mount
+	activationRetryDelay = 0
+
+	ms, err := storage.NewMetaStore(filepath.Join(root, "metadata.db"))
+	assert.NilError(t, err)
+	defer ms.Close()
+	config := &SnapConfig{
+		RootPath:   root,
+		VgName:     "vg",
+		ThinPool:   "pool",
+		ImageSize:  "1G",
+		FsType:     "xfs",
+		Encryption: EncryptionConfig{Enabled: true},
+	}
+	o := &snapshotter{
+		config:    config,
+		ms:        ms,
+		pools:     config.AllPools(),
+		keys:      newKeyProvider(config.Encryption, root),
+		hooks:     newHooks(config.Hooks),
+		events:    newEventBroker(),
+		locks:     newVolumeLocks(),
+		stopWatch: func() {},
+	}
+	test(namespaces.WithNamespace(context.Background(), "default"), o, f)
+}
+
+// assertConsistent checks that the volumes, the volume records and the
+// snapshots match and that no operation is left unfinished
+func assertConsistent(ctx context.Context, t *testing.T, o *snapshotter, f *fakeLVM, step string) {
+	var (
+		snapshots []string
+		records   []string
+		pending   map[string]intent
+	)
+	assert.NilError(t, o.withTransaction(ctx, false, func(ctx context.Context, tx storage.Transactor) error {
+		ids, err := storage.IDMap(ctx)
+		if err != nil {
+			return err
+		}
+		for id := range ids {
+			snapshots = append(snapshots, "vg/"+id)
+		}
+		if records, err = volumeIDs(tx); err != nil {
+			return err
+		}
+		pending, err = intents(tx)
+		return err
+	}), step)
+	assert.Equal(t, len(records), len(snapshots), step)
+	assert.Equal(t, len(pending), 0, step)
+	assert.DeepEqual(t, sorted(f.volumes()), sorted(snapshots))
+}
+
+func sorted(s []string) []string {
+	out := append([]string{}, s...)
+	sort.Strings(out)
+	return out
+}
+
+func prepare(key string) func(ctx context.Context, o *snapshotter) error {
+	return func(ctx context.Context, o *snapshotter) error {
+		_, err := o.Prepare(ctx, key, "")
+		return err
+	}
+}
+
+func commit(name, key string) func(ctx context.Context, o *snapshotter) error {
+	return func(ctx context.Context, o *snapshotter) error {
+		return o.Commit(ctx, name, key)
+	}
+}
+
+// steps returns the command lines op runs on a snapshotter prepared by setup
+func steps(t *testing.T, setup, op func(ctx context.Context, o *snapshotter) error) []string {
+	var calls []string
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		assert.NilError(t, setup(ctx, o))
+		f.calls = nil
+		assert.NilError(t, op(ctx, o))
+		calls = f.calls
+	})
+	assert.Assert(t, len(calls) > 0)
+	return calls
+}
+
+// assertActive checks that the snapshot is still active and its volume usable
+func assertActive(ctx context.Context, t *testing.T, o *snapshotter, key, step string) {
+	info, err := o.Stat(ctx, key)
+	assert.NilError(t, err, step)
+	assert.Equal(t, info.Kind, snapshots.KindActive, step)
+	_, err = o.Mounts(ctx, key)
+	assert.NilError(t, err, step)
+}
+
+func contains(calls []string, call string) bool {
+	for _, c := range calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Operations hooks run around
+const (
+	HookPrepare = "prepare"
+	HookView    = "view"
+	HookCommit  = "commit"
+	HookRemove  = "remove"
+)
+
+const (
+	hookPre  = "pre"
+	hookPost = "post"
+)
+
+// HookEvent is the document hooks receive on standard input. The ID and
+// device are always empty for the pre hooks of prepare and view, which run
+// before the snapshot exists. The device is gone after a snapshot is removed.
+type HookEvent struct {
+	// Operation is prepare, view, commit or remove
+	Operation string `json:"operation"`
+	// Phase is pre or post
+	Phase     string `json:"phase"`
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	// Name is the name an active snapshot is committed as
+	Name   string            `json:"name,omitempty"`
+	ID     string            `json:"id,omitempty"`
+	Kind   string            `json:"kind"`
+	Parent string            `json:"parent,omitempty"`
+	Device string            `json:"device,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type hook struct {
+	path       string
+	args       []string
+	operations map[string]bool
+	timeout    time.Duration
+}
+
+// hooks runs the configured executables around snapshot operations
+type hooks struct {
+	pre  []hook
+	post []hook
+}
+
+func newHooks(c HooksConfig) *hooks {
+	convert := func(configs []HookConfig) []hook {
+		var hs []hook
+		for _, c := range configs {
+			h := hook{path: c.Path, args: c.Args}
+			h.timeout, _ = time.ParseDuration(c.Timeout)
+			if len(c.Operations) > 0 {
+				h.operations = map[string]bool{}
+				for _, op := range c.Operations {
+					h.operations[op] = true
+				}
+			}
+			hs = append(hs, h)
+		}
+		return hs
+	}
+	return &hooks{pre: convert(c.Pre), post: convert(c.Post)}
+}
+
+func (h *hook) runsAround(operation string) bool {
+	return h.operations == nil || h.operations[operation]
+}
+
+func (h *hooks) phase(phase string) []hook {
+	if phase == hookPre {
+		return h.pre
+	}
+	return h.post
+}
+
+// has tells whether any hook runs in the phase of the operation, which spares
+// building events nobody reads
+func (h *hooks) has(phase, operation string) bool {
+	for _, hk := range h.phase(phase) {
+		if hk.runsAround(operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the hooks of the phase of the operation in their configured
+// order. The first pre hook to fail vetoes the operation, post hooks
+// failing are only logged.
+func (h *hooks) run(ctx context.Context, phase string, ev HookEvent) error {
+	ev.Phase = phase
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		ev.Namespace = ns
+	}
+	for _, hk := range h.phase(phase) {
+		if !hk.runsAround(ev.Operation) {
+			continue
+		}
+		if err := hk.run(ctx, ev); err != nil {
+			if phase == hookPre {
+				return errors.Wrapf(errdefs.ErrFailedPrecondition, "%s vetoed %s of %q: %v", hk.path, ev.Operation, ev.Key, err)
+			}
+			log.G(ctx).WithError(err).Warnf("Post %s hook %s failed", ev.Operation, hk.path)
+		}
+	}
+	return nil
+}
+
+func (h *hook) run(ctx context.Context, ev HookEvent) (err error) {
+	ctx, span := startSpan(ctx, "hook", attribute.String("hook.path", h.path), attribute.String("hook.phase", ev.Phase))
+	defer endSpan(span, &err)
+
+	input, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.Command(h.path, h.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// The hook runs in its own process group, so processes it started are
+	// killed along with it when it times out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return errors.Errorf("timed out after %s", h.timeout)
+	}
+	log.G(ctx).WithField("hook", h.path).Debugf("Ran %s %s hook: %s", ev.Phase, ev.Operation, bytes.TrimSpace(output.Bytes()))
+	if err != nil {
+		return errors.Errorf("%v: %s", err, bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
+
+// hookEvent describes an existing snapshot to the hooks
+func (o *snapshotter) hookEvent(ctx context.Context, operation, key string) (HookEvent, error) {
+	r, err := o.describe(ctx, key)
+	if err != nil {
+		return HookEvent{}, err
+	}
+	return o.recordHookEvent(operation, key, r), nil
+}
+
+func (o *snapshotter) recordHookEvent(operation, key string, r snapshotRecord) HookEvent {
+	return HookEvent{
+		Operation: operation,
+		Key:       key,
+		ID:        r.id,
+		Kind:      r.info.Kind.String(),
+		Parent:    r.info.Parent,
+		Labels:    r.info.Labels,
+		Device:    o.getSnapshotDir(r.vol, r.id),
+	}
+}
+
+// newSnapshotHookEvent describes a snapshot about to be created to the hooks
+func newSnapshotHookEvent(operation string, kind snapshots.Kind, key, parent string, opts []snapshots.Opt) (HookEvent, error) {
+	labels, err := optLabels(opts)
+	if err != nil {
+		return HookEvent{}, err
+	}
+	return HookEvent{
+		Operation: operation,
+		Key:       key,
+		Kind:      kind.String(),
+		Parent:    parent,
+		Labels:    labels,
+	}, nil
+}
+
+// optLabels returns the labels the options set
+func optLabels(opts []snapshots.Opt) (map[string]string, error) {
+	var info snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&info); err != nil {
+			return nil, err
+		}
+	}
+	return info.Labels, nil
+}
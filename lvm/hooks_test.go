@@ -0,0 +1,99 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"gotest.tools/assert"
+)
+
+// writeHook writes a hook script saving its input next to it
+func writeHook(t *testing.T, dir, name, body string) string {
+	path := filepath.Join(dir, name)
+	script := "#!/bin/sh\ncat > " + path + ".json\n" + body + "\n"
+	assert.NilError(t, ioutil.WriteFile(path, []byte(script), 0700))
+	return path
+}
+
+func TestHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lvm-hooks-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := HooksConfig{
+		Pre: []HookConfig{
+			{Path: writeHook(t, dir, "allow", "exit 0")},
+			{Path: writeHook(t, dir, "veto", "echo not scanned; exit 3"), Operations: []string{HookCommit}},
+			{Path: writeHook(t, dir, "slow", "sleep 10"), Operations: []string{HookRemove}, Timeout: "100ms"},
+		},
+		Post: []HookConfig{
+			{Path: writeHook(t, dir, "fail", "exit 1")},
+		},
+	}
+	for i := range config.Pre {
+		assert.NilError(t, config.Pre[i].validate())
+	}
+	assert.NilError(t, config.Post[0].validate())
+	h := newHooks(config)
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+
+	ev, err := newSnapshotHookEvent(HookPrepare, snapshots.KindActive, "key", "parent", []snapshots.Opt{withLabel("a", "b")})
+	assert.NilError(t, err)
+	assert.Assert(t, h.has(hookPre, HookPrepare))
+	assert.NilError(t, h.run(ctx, hookPre, ev))
+
+	input, err := ioutil.ReadFile(filepath.Join(dir, "allow.json"))
+	assert.NilError(t, err)
+	var received HookEvent
+	assert.NilError(t, json.Unmarshal(input, &received))
+	assert.DeepEqual(t, received, HookEvent{
+		Operation: HookPrepare,
+		Phase:     hookPre,
+		Namespace: "default",
+		Key:       "key",
+		Kind:      "Active",
+		Parent:    "parent",
+		Labels:    map[string]string{"a": "b"},
+	})
+	_, err = os.Stat(filepath.Join(dir, "veto.json"))
+	assert.Assert(t, os.IsNotExist(err), "hook ran for an operation it was not configured for")
+
+	err = h.run(ctx, hookPre, HookEvent{Operation: HookCommit, Key: "key"})
+	assert.Assert(t, errdefs.IsFailedPrecondition(err))
+	assert.ErrorContains(t, err, "vetoed commit of \"key\": exit status 3: not scanned")
+
+	start := time.Now()
+	err = h.run(ctx, hookPre, HookEvent{Operation: HookRemove, Key: "key"})
+	assert.Assert(t, errdefs.IsFailedPrecondition(err))
+	assert.ErrorContains(t, err, "timed out after 100ms")
+	assert.Assert(t, time.Since(start) < 5*time.Second)
+
+	// Post hooks can not undo the operation, their failures are only logged
+	assert.NilError(t, h.run(ctx, hookPost, HookEvent{Operation: HookRemove, Key: "key"}))
+}
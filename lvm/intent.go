@@ -0,0 +1,325 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+// Operations recorded in the intent log. Creations and commits are rolled
+// back when they were interrupted, removals and resizes rolled forward.
+// Resets are rolled back until the volume is deleted and forward after.
+const (
+	intentCreate = "create"
+	intentCommit = "commit"
+	intentRemove = "remove"
+	intentResize = "resize"
+	intentReset  = "reset"
+)
+
+// recordIntent writes the intent of an operation in a transaction of its own,
+// before the operation touches the volume
+func (o *snapshotter) recordIntent(ctx context.Context, id string, in intent) error {
+	if err := o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		return putIntent(t, id, in)
+	}); err != nil {
+		return errors.Wrapf(err, "Unable to record %s intent", in.Op)
+	}
+	return nil
+}
+
+// clearIntent drops the intent of an operation which failed without a crash.
+// An intent left behind is recovered on the next start.
+func (o *snapshotter) clearIntent(ctx context.Context, id string) {
+	if err := o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		return deleteIntent(t, id)
+	}); err != nil {
+		log.G(ctx).WithError(err).Warnf("Unable to clear intent of snapshot %s", id)
+	}
+}
+
+// recoverIntents completes or undoes the operations interrupted by a crash of
+// the snapshotter. Operations that can not be recovered are logged and kept
+// for the next start.
+func (o *snapshotter) recoverIntents(ctx context.Context) error {
+	var pending map[string]intent
+	if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) (err error) {
+		pending, err = intents(t)
+		return err
+	}); err != nil {
+		return err
+	}
+	for id, in := range pending {
+		ctx := withSnapshotID(withSnapshotKey(ctx, in.Key), id)
+		log.G(ctx).Infof("Recovering interrupted %s of snapshot %s", in.Op, in.Key)
+		var err error
+		switch in.Op {
+		case intentCreate:
+			err = o.rollbackCreate(ctx, id, in)
+		case intentCommit:
+			err = o.rollbackCommit(ctx, id, in)
+		case intentRemove:
+			err = o.replayRemove(ctx, id, in)
+		case intentResize:
+			err = o.replayResize(ctx, id, in)
+		case intentReset:
+			err = o.recoverReset(ctx, id, in)
+		default:
+			err = errors.Errorf("unknown operation %q", in.Op)
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("Unable to recover interrupted %s of snapshot %s", in.Op, in.Key)
+		}
+	}
+	return nil
+}
+
+// rollbackCreate deletes what was built of the volume of a snapshot that was
+// never published, along with its reservation
+func (o *snapshotter) rollbackCreate(ctx context.Context, id string, in intent) error {
+	if err := o.dropLeftovers(ctx, in.Volume, id); err != nil {
+		return err
+	}
+	var dropKey bool
+	if err := o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if current, _, _, err := storage.GetInfo(ctx, in.Key); err == nil && current == id {
+			if _, _, err := storage.Remove(ctx, in.Key); err != nil {
+				return err
+			}
+		}
+		if err := deleteVolume(t, id); err != nil {
+			return err
+		}
+		if in.Volume.Encrypted && in.Volume.KeyID == id {
+			inUse, err := keyInUse(t, id)
+			if err != nil {
+				return err
+			}
+			dropKey = !inUse
+		}
+		return deleteIntent(t, id)
+	}); err != nil {
+		return err
+	}
+	if dropKey {
+		if err := o.keys.delete(id); err != nil {
+			log.G(ctx).WithError(err).Warnf("Unable to delete key %s", id)
+		}
+	}
+	return nil
+}
+
+// rollbackCommit hands the volume of a snapshot whose commit was never
+// published back to the active snapshot
+func (o *snapshotter) rollbackCommit(ctx context.Context, id string, in intent) error {
+	vol := in.Volume
+	if err := o.rollbackDetach(ctx, vol, id); err != nil {
+		return err
+	}
+	if exists, err := lvExists(ctx, vol.VgName, hashLVName(id)); err != nil {
+		return err
+	} else if exists {
+		if err := o.removeOrphan(ctx, vol.VgName, hashLVName(id)); err != nil {
+			return err
+		}
+	}
+	active := false
+	if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		current, _, _, err := storage.GetInfo(ctx, in.Key)
+		active = err == nil && current == id
+		return nil
+	}); err != nil {
+		return err
+	}
+	if active {
+		if err := o.activateVolume(ctx, vol, id); err != nil {
+			return errors.Wrap(err, "Unable to reactivate volume")
+		}
+	}
+	return o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		return deleteIntent(t, id)
+	})
+}
+
+// rollbackDetach gives a mounted volume detached by an interrupted commit its
+// name back and deletes the copy that was to be committed
+func (o *snapshotter) rollbackDetach(ctx context.Context, vol volume, id string) error {
+	detached, err := lvExists(ctx, vol.VgName, detachedLVName(id))
+	if err != nil {
+		return err
+	}
+	if detached {
+		exists, err := lvExists(ctx, vol.VgName, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			// The copy already took over the name of the volume
+			if out, err := removeLVMVolume(ctx, vol.VgName, id); err != nil {
+				return errors.Wrapf(err, "Unable to delete committed copy: %s", out)
+			}
+		}
+		if out, err := renameLVMVolume(ctx, vol.VgName, detachedLVName(id), id); err != nil {
+			return errors.Wrapf(err, "Unable to rename detached volume: %s", out)
+		}
+	}
+	if exists, err := lvExists(ctx, vol.VgName, commitLVName(id)); err != nil {
+		return err
+	} else if exists {
+		if out, err := removeLVMVolume(ctx, vol.VgName, commitLVName(id)); err != nil {
+			return errors.Wrapf(err, "Unable to delete committed copy: %s", out)
+		}
+	}
+	return nil
+}
+
+// replayRemove finishes tearing down the volume of a removed snapshot
+func (o *snapshotter) replayRemove(ctx context.Context, id string, in intent) error {
+	vol := in.Volume
+	if vol.VerityOf == "" && o.config.WipePolicy != "" {
+		exists, err := lvExists(ctx, vol.VgName, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := o.wipeVolume(ctx, in.Key, vol, id); err != nil {
+				return errors.Wrap(err, "Unable to wipe volume")
+			}
+		}
+	}
+	if err := o.dropLeftovers(ctx, vol, id); err != nil {
+		return err
+	}
+	var dropKey bool
+	if err := o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if err := deleteVolume(t, id); err != nil {
+			return err
+		}
+		if vol.Encrypted {
+			inUse, err := keyInUse(t, vol.KeyID)
+			if err != nil {
+				return err
+			}
+			dropKey = !inUse
+		}
+		return deleteIntent(t, id)
+	}); err != nil {
+		return err
+	}
+	if dropKey {
+		if err := o.keys.delete(vol.KeyID); err != nil {
+			log.G(ctx).WithError(err).Warnf("Unable to delete key %s", vol.KeyID)
+		}
+	}
+	return nil
+}
+
+// replayResize grows the volume and filesystem of the snapshot again, which
+// skips the steps that were done already
+func (o *snapshotter) replayResize(ctx context.Context, id string, in intent) error {
+	var (
+		s     storage.Snapshot
+		found bool
+	)
+	if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		var err error
+		s, err = storage.GetSnapshot(ctx, in.Key)
+		found = err == nil && s.ID == id
+		return nil
+	}); err != nil {
+		return err
+	}
+	if found {
+		if err := o.growVolume(ctx, s, in.Volume, in.Size); err != nil {
+			return err
+		}
+	}
+	return o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		return deleteIntent(t, id)
+	})
+}
+
+// recoverReset deletes the replacement volume of an interrupted reset while
+// the volume it was to replace still exists, and puts it in place otherwise
+func (o *snapshotter) recoverReset(ctx context.Context, id string, in intent) error {
+	vol := in.Volume
+	tmp := resetLVName(id)
+	replacement, err := lvExists(ctx, vol.VgName, tmp)
+	if err != nil {
+		return err
+	}
+	if replacement {
+		exists, err := lvExists(ctx, vol.VgName, id)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := o.removeOrphan(ctx, vol.VgName, tmp); err != nil {
+				return err
+			}
+		} else if out, err := renameLVMVolume(ctx, vol.VgName, tmp, id); err != nil {
+			return errors.Wrapf(err, "Unable to rename replacement volume: %s", out)
+		}
+	}
+	active := false
+	if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		current, _, _, err := storage.GetInfo(ctx, in.Key)
+		active = err == nil && current == id
+		return nil
+	}); err != nil {
+		return err
+	}
+	if active {
+		if err := o.activateVolume(ctx, vol, id); err != nil {
+			return errors.Wrap(err, "Unable to reactivate volume")
+		}
+	}
+	return o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		return deleteIntent(t, id)
+	})
+}
+
+// dropLeftovers deletes whatever exists of the volume with the given ID and
+// of its hash volume
+func (o *snapshotter) dropLeftovers(ctx context.Context, vol volume, id string) error {
+	if vol.VerityOf != "" {
+		// Views only have a verity device
+		if out, err := verityClose(ctx, verityName(vol.VgName, id)); err != nil {
+			return errors.Wrapf(err, "veritysetup close failed: %s", out)
+		}
+		return nil
+	}
+	for _, lvname := range []string{hashLVName(id), id} {
+		exists, err := lvExists(ctx, vol.VgName, lvname)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := o.removeOrphan(ctx, vol.VgName, lvname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	bolt "go.etcd.io/bbolt"
+	"gotest.tools/assert"
+)
+
+func TestIntentRecords(t *testing.T) {
+	root, err := ioutil.TempDir("", "lvm-intents")
+	assert.NilError(t, err)
+	defer os.RemoveAll(root)
+
+	db, err := bolt.Open(filepath.Join(root, "metadata.db"), 0600, nil)
+	assert.NilError(t, err)
+	defer db.Close()
+
+	// Reading before anything was written finds nothing
+	assert.NilError(t, db.View(func(tx *bolt.Tx) error {
+		records, err := intents(tx)
+		assert.NilError(t, err)
+		assert.Equal(t, len(records), 0)
+		return nil
+	}))
+
+	create := intent{Op: intentCreate, Key: "active", Volume: volume{Pool: "default", VgName: "vg", ThinPool: "pool"}}
+	resize := intent{Op: intentResize, Key: "other", Size: 1 << 30}
+	assert.NilError(t, db.Update(func(tx *bolt.Tx) error {
+		assert.NilError(t, putIntent(tx, "1", create))
+		assert.NilError(t, putIntent(tx, "2", resize))
+		return nil
+	}))
+	assert.NilError(t, db.Update(func(tx *bolt.Tx) error {
+		records, err := intents(tx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, records, map[string]intent{"1": create, "2": resize})
+		return deleteIntent(tx, "1")
+	}))
+	assert.NilError(t, db.View(func(tx *bolt.Tx) error {
+		records, err := intents(tx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, records, map[string]intent{"2": resize})
+		return nil
+	}))
+}
+
+func TestRemoveRecovery(t *testing.T) {
+	remove := func(ctx context.Context, o *snapshotter) error {
+		return o.Remove(ctx, "active")
+	}
+	for _, step := range steps(t, prepare("active"), remove) {
+		withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+			assert.NilError(t, prepare("active")(ctx, o))
+			f.fail = step
+			assert.ErrorContains(t, remove(ctx, o), "", step)
+			f.fail = ""
+
+			// The snapshot is gone from the metadata, its removal is
+			// completed from the intent log rather than by Cleanup
+			_, err := o.Stat(ctx, "active")
+			assert.Assert(t, errdefs.IsNotFound(err), step)
+			report, err := o.Reconcile(ctx, false)
+			assert.NilError(t, err, step)
+			assert.Equal(t, len(report.OrphanVolumes)+len(report.StaleRecords), 0, step)
+			assert.NilError(t, o.recoverIntents(ctx))
+			_, err = o.keys.get("1")
+			assert.ErrorContains(t, err, "Unable to read key 1", step)
+			assertConsistent(ctx, t, o, f, step)
+		})
+	}
+}
+
+func TestResizeRecovery(t *testing.T) {
+	resize := func(ctx context.Context, o *snapshotter) error {
+		return o.Resize(ctx, "active", 2<<30)
+	}
+	for _, step := range steps(t, prepare("active"), resize) {
+		withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+			assert.NilError(t, prepare("active")(ctx, o))
+			f.fail = step
+			assert.ErrorContains(t, resize(ctx, o), "", step)
+			f.fail = ""
+
+			// A failed resize is completed rather than undone, unless it
+			// failed before touching the volume
+			assert.NilError(t, o.recoverIntents(ctx))
+			if f.sizes["vg/1"] != "2147483648" {
+				assert.NilError(t, resize(ctx, o), step)
+			}
+			assert.Equal(t, f.sizes["vg/1"], "2147483648", step)
+			assertActive(ctx, t, o, "active", step)
+			assertConsistent(ctx, t, o, f, step)
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/sirupsen/logrus"
+)
+
+// withSnapshotKey tags the log lines of an operation with the containerd
+// namespace and the key of the snapshot it works on. Operations on no
+// snapshot in particular pass an empty key.
+func withSnapshotKey(ctx context.Context, key string) context.Context {
+	fields := logrus.Fields{}
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		fields["namespace"] = ns
+	}
+	if key != "" {
+		fields["key"] = key
+	}
+	return log.WithLogger(ctx, log.G(ctx).WithFields(fields))
+}
+
+// withSnapshotID tags the log lines of an operation with the ID of the
+// snapshot, which names its logical volume, once it is known
+func withSnapshotID(ctx context.Context, id string) context.Context {
+	return log.WithLogger(ctx, log.G(ctx).WithField("id", id))
+}
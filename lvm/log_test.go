@@ -0,0 +1,65 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/sirupsen/logrus"
+	"gotest.tools/assert"
+)
+
+func TestCommandLogFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Level = logrus.DebugLevel
+	logger.Formatter = &logrus.JSONFormatter{}
+
+	ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+	ctx = namespaces.WithNamespace(ctx, "k8s.io")
+	ctx = withSnapshotKey(ctx, "layer-1")
+	ctx = withSnapshotID(ctx, "snap_7")
+	out, err := runCommand(ctx, "echo", []string{"created"})
+	assert.NilError(t, err)
+	assert.Equal(t, out, "created")
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		assert.NilError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	assert.Equal(t, len(lines), 2)
+	for _, line := range lines {
+		assert.Equal(t, line["namespace"], "k8s.io")
+		assert.Equal(t, line["key"], "layer-1")
+		assert.Equal(t, line["id"], "snap_7")
+		assert.Equal(t, line["command"], "echo")
+	}
+	assert.Equal(t, lines[0]["msg"], "Running echo created")
+	assert.Equal(t, lines[1]["msg"], "Command succeeded: created")
+}
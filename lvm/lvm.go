@@ -19,21 +19,30 @@
 package lvm
 
 import (
+	"bytes"
+	"context"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const retries = 10
 
+// activationRetryDelay is how much longer every retry of a failed activation
+// waits for the IO on the volume to complete
+var activationRetryDelay = time.Second
+
 // This global mutex is used only during volume group creation and deletion
 // which will be only executed during test code to mitigate
 // https://bugzilla.redhat.com/show_bug.cgi?id=1672336. This should have no
@@ -41,7 +50,11 @@ const retries = 10
 // been created.
 var mutex sync.Mutex
 
-func formatVolume(vgname string, lvname string, fstype string) error {
+func formatVolume(ctx context.Context, vgname string, lvname string, fstype string) error {
+	return formatDevice(ctx, filepath.Join("/dev/", vgname, lvname), fstype)
+}
+
+func formatDevice(ctx context.Context, device string, fstype string) error {
 	var mkfsArgs []string
 	switch fstype {
 	case "ext4":
@@ -52,24 +65,48 @@ func formatVolume(vgname string, lvname string, fstype string) error {
 	}
 
 	cmd := "mkfs." + fstype
-	mkfsArgs = append(mkfsArgs, filepath.Join("/dev/", vgname, lvname))
-	_, err := runCommand(cmd, mkfsArgs)
+	mkfsArgs = append(mkfsArgs, device)
+	_, err := runCommand(ctx, cmd, mkfsArgs)
 	return err
 }
 
-func unmountVolume(vgname string, lvname string) error {
+// regenerateUUID gives the filesystem on a copied device a new UUID so it can
+// be mounted next to the original
+func regenerateUUID(ctx context.Context, device string, fstype string) (string, error) {
+	switch fstype {
+	case "ext4":
+		// A copy of a mounted ext4 filesystem still needs its journal
+		// replayed, which tune2fs refuses to change the UUID of. e2fsck exits
+		// with 1 when it fixed something.
+		out, err := runCommandOnce(ctx, "e2fsck", []string{"-f", "-y", device})
+		if err != nil && err.Error() != "exit status 1" {
+			return out, err
+		}
+		return runCommand(ctx, "tune2fs", []string{"-f", "-U", "random", device})
+	case "xfs":
+		return runCommand(ctx, "xfs_admin", []string{"-U", "generate", device})
+	default:
+		return "", errors.Errorf("unsupported filesystem %s", fstype)
+	}
+}
+
+func unmountVolume(ctx context.Context, vgname string, lvname string) error {
+	return unmountDevice(ctx, filepath.Join("/dev", vgname, lvname))
+}
+
+func unmountDevice(ctx context.Context, device string) error {
 	cmd := "umount"
-	args := []string{"--lazy", "--force", "--all-targets", filepath.Join("/dev", vgname, lvname)}
+	args := []string{"--lazy", "--force", "--all-targets", device}
 	var re = regexp.MustCompile(`not mounted|not found`)
 
-	output, err := runCommand(cmd, args)
+	output, err := runCommand(ctx, cmd, args)
 	if err != nil && !re.MatchString(output) {
 		return errors.Wrap(err, "Unable to remove volume mounts")
 	}
 	return nil
 }
 
-func createLVMVolume(lvname string, vgname string, lvpoolname string, size string, parent string, kind snapshots.Kind) (string, error) {
+func createLVMVolume(ctx context.Context, lvname string, vgname string, lvpoolname string, size string, parent string, kind snapshots.Kind) (string, error) {
 	cmd := "lvcreate"
 	args := []string{}
 	out := ""
@@ -89,69 +126,269 @@ func createLVMVolume(lvname string, vgname string, lvpoolname string, size strin
 	//}
 
 	//Let's go and create the volume
-	if out, err = runCommand(cmd, args); err != nil {
+	if out, err = runCommand(ctx, cmd, args); err != nil {
 		return out, errors.Wrap(err, "Unable to create volume")
 	}
 
 	return out, err
 }
 
-func removeLVMVolume(vgname string, lvname string) (string, error) {
+func removeLVMVolume(ctx context.Context, vgname string, lvname string) (string, error) {
 
 	cmd := "lvremove"
 	args := []string{"-y", vgname + "/" + lvname}
 
-	return runCommand(cmd, args)
+	return runCommand(ctx, cmd, args)
 }
 
-func createVolumeGroup(drive string, vgname string) (string, error) {
+func renameLVMVolume(ctx context.Context, vgname string, lvname string, newname string) (string, error) {
+	cmd := "lvrename"
+	args := []string{vgname, lvname, newname}
+
+	return runCommand(ctx, cmd, args)
+}
+
+func createVolumeGroup(ctx context.Context, drives string, vgname string) (string, error) {
 	mutex.Lock()
 	defer mutex.Unlock()
 	cmd := "vgcreate"
-	args := []string{vgname, drive}
+	args := append([]string{vgname}, strings.Fields(drives)...)
 
-	return runCommand(cmd, args)
+	return runCommand(ctx, cmd, args)
 }
 
-func createLogicalThinPool(vgname string, lvpool string) (string, error) {
+func createLogicalThinPool(ctx context.Context, vgname string, lvpool string, opts ThinPoolOptions) (string, error) {
 	cmd := "lvcreate"
-	args := []string{"--thinpool", lvpool, "--extents", "90%FREE", vgname}
-
-	out, err := runCommand(cmd, args)
-	if err != nil && (err.Error() == "exit status 5") {
-		return out, nil
+	args := thinPoolArgs(vgname, lvpool, opts)
+
+	out, err := runCommandOnce(ctx, cmd, args)
+	if err != nil {
+		// lvcreate can report a failure after creating the pool, when
+		// waiting for udev times out. Only trust it if the pool is missing.
+		if _, cerr := checkLV(ctx, vgname, lvpool); cerr == nil {
+			return out, nil
+		}
 	}
 	return out, err
 }
 
-func deleteVolumeGroup(vgname string) (string, error) {
+func deleteVolumeGroup(ctx context.Context, vgname string) (string, error) {
 	mutex.Lock()
 	defer mutex.Unlock()
 	cmd := "vgremove"
 	args := []string{"-y", vgname}
 
-	return runCommand(cmd, args)
+	return runCommand(ctx, cmd, args)
 }
 
-func checkVG(vgname string) (string, error) {
+func checkVG(ctx context.Context, vgname string) (string, error) {
 	var err error
 	output := ""
 	cmd := "vgs"
 	args := []string{vgname, "--options", "vg_name", "--no-headings"}
-	output, err = runCommand(cmd, args)
+	output, err = runCommand(ctx, cmd, args)
 	return output, err
 }
 
-func checkLV(vgname string, lvname string) (string, error) {
+func checkLV(ctx context.Context, vgname string, lvname string) (string, error) {
 	var err error
 	output := ""
 	cmd := "lvs"
 	args := []string{vgname + "/" + lvname, "--options", "lv_name", "--no-heading"}
-	output, err = runCommand(cmd, args)
+	output, err = runCommand(ctx, cmd, args)
 	return output, err
 }
 
-func toggleactivateLV(vgname string, lvname string, activate bool) (string, error) {
+// lvExists tells whether the logical volume exists
+func lvExists(ctx context.Context, vgname string, lvname string) (bool, error) {
+	var re = regexp.MustCompile(`Failed to find|not found`)
+	args := []string{vgname + "/" + lvname, "--options", "lv_name", "--no-heading"}
+	output, err := runCommandOnce(ctx, "lvs", args)
+	if err != nil {
+		if re.MatchString(output) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "Unable to query volume %s/%s: %s", vgname, lvname, output)
+	}
+	return true, nil
+}
+
+// poolFreeSpace returns the number of bytes that are still unallocated in the
+// data area of the thin pool.
+func poolFreeSpace(ctx context.Context, vgname string, lvpoolname string) (uint64, error) {
+	cmd := "lvs"
+	args := []string{vgname + "/" + lvpoolname, "--options", "lv_size,data_percent", "--units", "b", "--nosuffix", "--noheadings"}
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to query pool %s/%s: %s", vgname, lvpoolname, output)
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return 0, errors.Errorf("Unexpected lvs output for pool %s/%s: %q", vgname, lvpoolname, output)
+	}
+	size, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to parse size of pool %s/%s", vgname, lvpoolname)
+	}
+	used, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to parse usage of pool %s/%s", vgname, lvpoolname)
+	}
+	return uint64(float64(size) * (100 - used) / 100), nil
+}
+
+// lvSize returns the size of the logical volume in bytes
+func lvSize(ctx context.Context, vgname string, lvname string) (uint64, error) {
+	cmd := "lvs"
+	args := []string{vgname + "/" + lvname, "--options", "lv_size", "--units", "b", "--nosuffix", "--noheadings"}
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to query volume %s/%s: %s", vgname, lvname, output)
+	}
+	size, err := strconv.ParseUint(output, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to parse size of volume %s/%s", vgname, lvname)
+	}
+	return size, nil
+}
+
+// lvUsedSpace returns the number of bytes of the thin volume that are mapped
+// in the pool
+func lvUsedSpace(ctx context.Context, vgname string, lvname string) (int64, error) {
+	cmd := "lvs"
+	args := []string{vgname + "/" + lvname, "--options", "lv_size,data_percent", "--units", "b", "--nosuffix", "--noheadings"}
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to query volume %s/%s: %s", vgname, lvname, output)
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return 0, errors.Errorf("Unexpected lvs output for volume %s/%s: %q", vgname, lvname, output)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to parse size of volume %s/%s", vgname, lvname)
+	}
+	used, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to parse usage of volume %s/%s", vgname, lvname)
+	}
+	return int64(float64(size) * used / 100), nil
+}
+
+// poolUsage is the state of a thin pool as reported by lvs
+type poolUsage struct {
+	size            uint64
+	dataPercent     float64
+	metadataPercent float64
+	health          string
+}
+
+// poolStatus queries the size, usage and health of the thin pool
+func poolStatus(ctx context.Context, vgname string, lvpoolname string) (poolUsage, error) {
+	cmd := "lvs"
+	args := []string{vgname + "/" + lvpoolname, "--options", "lv_size,data_percent,metadata_percent,lv_health_status", "--units", "b", "--nosuffix", "--noheadings", "--separator", ","}
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil {
+		return poolUsage{}, errors.Wrapf(err, "Unable to query pool %s/%s: %s", vgname, lvpoolname, output)
+	}
+	return parsePoolStatus(output)
+}
+
+func parsePoolStatus(output string) (poolUsage, error) {
+	var u poolUsage
+	fields := strings.Split(strings.TrimSpace(output), ",")
+	if len(fields) != 4 {
+		return u, errors.Errorf("Unexpected lvs output for pool: %q", output)
+	}
+	var err error
+	if u.size, err = strconv.ParseUint(strings.TrimSpace(fields[0]), 10, 64); err != nil {
+		return u, errors.Wrap(err, "Unable to parse pool size")
+	}
+	if u.dataPercent, err = strconv.ParseFloat(strings.TrimSpace(fields[1]), 64); err != nil {
+		return u, errors.Wrap(err, "Unable to parse pool data usage")
+	}
+	if u.metadataPercent, err = strconv.ParseFloat(strings.TrimSpace(fields[2]), 64); err != nil {
+		return u, errors.Wrap(err, "Unable to parse pool metadata usage")
+	}
+	// lvs leaves the health status empty for healthy volumes
+	u.health = strings.TrimSpace(fields[3])
+	return u, nil
+}
+
+// thinVolumes returns the names of the thin volumes of the pool
+func thinVolumes(ctx context.Context, vgname string, lvpoolname string) ([]string, error) {
+	cmd := "lvs"
+	args := []string{vgname, "--options", "lv_name,pool_lv", "--noheadings", "--separator", ","}
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to list volumes of %s: %s", vgname, output)
+	}
+	return parseThinVolumes(output, lvpoolname), nil
+}
+
+func parseThinVolumes(output string, lvpoolname string) []string {
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) == 2 && fields[1] == lvpoolname {
+			names = append(names, fields[0])
+		}
+	}
+	return names
+}
+
+// activeThinVolumes returns the number of active thin volumes of the pool
+func activeThinVolumes(ctx context.Context, vgname string, lvpoolname string) (int, error) {
+	cmd := "lvs"
+	args := []string{vgname, "--options", "lv_name,pool_lv,lv_active", "--noheadings", "--separator", ","}
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to list volumes of %s: %s", vgname, output)
+	}
+	return countActiveThinVolumes(output, lvpoolname), nil
+}
+
+func countActiveThinVolumes(output string, lvpoolname string) int {
+	n := 0
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) == 3 && fields[1] == lvpoolname && fields[2] == "active" {
+			n++
+		}
+	}
+	return n
+}
+
+func extendLVMVolume(ctx context.Context, vgname string, lvname string, size uint64) (string, error) {
+	cmd := "lvextend"
+	args := []string{"--size", strconv.FormatUint(size, 10) + "b", vgname + "/" + lvname}
+	return runCommand(ctx, cmd, args)
+}
+
+// growFilesystem grows the filesystem mounted at mountpoint from device to
+// the size of the device
+func growFilesystem(ctx context.Context, device string, mountpoint string, fstype string) (string, error) {
+	switch fstype {
+	case "ext4":
+		return runCommand(ctx, "resize2fs", []string{device})
+	case "xfs":
+		return runCommand(ctx, "xfs_growfs", []string{mountpoint})
+	default:
+		return "", errors.Errorf("unsupported filesystem %s", fstype)
+	}
+}
+
+// filesystemUUID returns the UUID of the filesystem on the device
+func filesystemUUID(ctx context.Context, device string) (string, error) {
+	cmd := "blkid"
+	args := []string{"--match-tag", "UUID", "--output", "value", device}
+	return runCommandOnce(ctx, cmd, args)
+}
+
+func toggleactivateLV(ctx context.Context, vgname string, lvname string, activate bool) (string, error) {
 	cmd := "lvchange"
 	args := []string{"-K", vgname + "/" + lvname, "-a"}
 	output := ""
@@ -168,10 +405,10 @@ func toggleactivateLV(vgname string, lvname string, activate bool) (string, erro
 	// data corruption when the volume is hidden from the host. Adding delay here
 	// for IO completion and proper unmounting.
 	for ret < retries {
-		output, err = runCommand(cmd, args)
+		output, err = runCommand(ctx, cmd, args)
 		if err != nil {
 			ret++
-			time.Sleep(time.Duration(ret) * time.Second)
+			time.Sleep(time.Duration(ret) * activationRetryDelay)
 		} else {
 			break
 		}
@@ -179,7 +416,7 @@ func toggleactivateLV(vgname string, lvname string, activate bool) (string, erro
 	return output, err
 }
 
-func toggleactivateVG(vgname string, activate bool) (string, error) {
+func toggleactivateVG(ctx context.Context, vgname string, activate bool) (string, error) {
 	cmd := "vgchange"
 	args := []string{"-K", vgname, "-a"}
 	output := ""
@@ -190,32 +427,86 @@ func toggleactivateVG(vgname string, activate bool) (string, error) {
 	} else {
 		args = append(args, "n")
 	}
-	output, err = runCommand(cmd, args)
+	output, err = runCommand(ctx, cmd, args)
 	return output, err
 }
 
-func runCommand(cmd string, args []string) (string, error) {
+func runCommand(ctx context.Context, cmd string, args []string) (string, error) {
+	return runCommandWithInput(ctx, cmd, args, nil)
+}
+
+// runCommandWithInput runs the command with input fed to its standard input,
+// which keeps secrets like encryption keys off the command line.
+func runCommandWithInput(ctx context.Context, cmd string, args []string, input []byte) (string, error) {
+	return execCommand(ctx, cmd, args, input, retries)
+}
+
+// runCommandOnce runs commands whose failure is meaningful and which must not
+// be retried, like verifying a volume.
+func runCommandOnce(ctx context.Context, cmd string, args []string) (string, error) {
+	return execCommand(ctx, cmd, args, nil, 1)
+}
+
+// commandRunner runs a command once and returns its combined output
+type commandRunner func(ctx context.Context, cmd string, args []string, input []byte) ([]byte, error)
+
+// runner runs the commands of the snapshotter. Tests replace it to fake the
+// tools and to inject failures.
+var runner commandRunner = execRunner
+
+func execRunner(ctx context.Context, cmd string, args []string, input []byte) ([]byte, error) {
+	c := exec.Command(cmd, args...)
+	c.Env = os.Environ()
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+		Setpgid:   true,
+	}
+	if input != nil {
+		c.Stdin = bytes.NewReader(input)
+	}
+	return c.CombinedOutput()
+}
+
+func execCommand(ctx context.Context, cmd string, args []string, input []byte, attempts int) (_ string, err error) {
 	var output []byte
 	ret := 0
-	var err error
-
-	// Pass context down and log into the tool instead of this.
-	// fmt.Printf("Running command %s with args: %s\n", cmd, args)
-	for ret < retries {
-		c := exec.Command(cmd, args...)
-		c.Env = os.Environ()
-		c.SysProcAttr = &syscall.SysProcAttr{
-			Pdeathsig: syscall.SIGTERM,
-			Setpgid:   true,
+	start := time.Now()
+	_, span := startSpan(ctx, cmd, attribute.Array("command.args", args))
+	defer func() {
+		retries := ret
+		if err != nil {
+			retries = ret - 1
+			span.SetAttributes(attribute.String("command.output", strings.TrimSpace(string(output))))
 		}
-
-		output, err = c.CombinedOutput()
+		span.SetAttributes(attribute.Int("command.retries", retries))
+		endSpan(span, &err)
+		observeCommand(cmd, start, retries, err)
+	}()
+
+	release, err := commandScheduler.acquire(ctx, cmd)
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to schedule %s", cmd)
+	}
+	defer release()
+	// The time spent waiting for a slot is not part of the duration of
+	// the command
+	span.SetAttributes(attribute.Float64("command.queued_seconds", time.Since(start).Seconds()))
+	start = time.Now()
+
+	logger := log.G(ctx).WithField("command", cmd)
+	logger.Debugf("Running %s %s", cmd, strings.Join(args, " "))
+	for ret < attempts {
+		output, err = runner(ctx, cmd, args, input)
 		if err == nil {
 			break
 		}
 		ret++
+		logger.WithError(err).Debugf("Attempt %d of %d failed: %s", ret, attempts, strings.TrimSpace(string(output)))
 		time.Sleep(100000 * time.Nanosecond)
 	}
 
+	if err == nil {
+		logger.WithField("duration", time.Since(start)).Debugf("Command succeeded: %s", strings.TrimSpace(string(output)))
+	}
 	return strings.TrimSpace(string(output)), err
 }
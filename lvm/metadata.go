@@ -0,0 +1,274 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"encoding/json"
+
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The snapshotter keeps its own records next to the ones maintained by
+// containerd's storage package in metadata.db. They live in a separate bucket
+// so the storage package never sees them.
+var (
+	bucketKeyLVM     = []byte("lvm")
+	bucketKeyVolumes = []byte("volumes")
+	bucketKeyIntents = []byte("intents")
+)
+
+// volume is the snapshotter's record of the logical volume backing a
+// snapshot, keyed by the snapshot ID.
+type volume struct {
+	// Pool is the name of the pool the volume was placed in
+	Pool string `json:"pool"`
+
+	// VgName and ThinPool locate the logical volume
+	VgName   string `json:"vg"`
+	ThinPool string `json:"thin_pool"`
+
+	// Encrypted volumes carry LUKS and are opened with the key of KeyID
+	Encrypted bool   `json:"encrypted,omitempty"`
+	KeyID     string `json:"key_id,omitempty"`
+
+	// VerityHash is the root hash of the hash tree of a protected volume
+	VerityHash string `json:"verity_hash,omitempty"`
+
+	// VerityOf is set on views served from the verity device of the
+	// protected volume with this ID. They have no logical volume of their own.
+	VerityOf string `json:"verity_of,omitempty"`
+
+	// Block volumes are handed out as raw devices and never mounted on the
+	// host while they are active
+	Block bool `json:"block,omitempty"`
+
+	// State is set while the volume is being created or removed
+	State string `json:"state,omitempty"`
+}
+
+func boltTx(t storage.Transactor) (*bolt.Tx, error) {
+	if traced, ok := t.(*tracedTx); ok {
+		t = traced.Transactor
+	}
+	tx, ok := t.(*bolt.Tx)
+	if !ok {
+		return nil, errors.Errorf("unsupported transaction type %T", t)
+	}
+	return tx, nil
+}
+
+func volumesBucket(t storage.Transactor, create bool) (*bolt.Bucket, error) {
+	return lvmBucket(t, bucketKeyVolumes, create)
+}
+
+func lvmBucket(t storage.Transactor, key []byte, create bool) (*bolt.Bucket, error) {
+	tx, err := boltTx(t)
+	if err != nil {
+		return nil, err
+	}
+	if !create {
+		bkt := tx.Bucket(bucketKeyLVM)
+		if bkt == nil {
+			return nil, nil
+		}
+		return bkt.Bucket(key), nil
+	}
+	bkt, err := tx.CreateBucketIfNotExists(bucketKeyLVM)
+	if err != nil {
+		return nil, err
+	}
+	return bkt.CreateBucketIfNotExists(key)
+}
+
+// getVolume returns the record of the volume with the given ID. The boolean
+// is false when no record exists, which is the case for volumes created before
+// records were kept.
+func getVolume(t storage.Transactor, id string) (volume, bool, error) {
+	var v volume
+	bkt, err := volumesBucket(t, false)
+	if err != nil || bkt == nil {
+		return v, false, err
+	}
+	data := bkt.Get([]byte(id))
+	if data == nil {
+		return v, false, nil
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, false, errors.Wrapf(err, "failed to decode volume record %s", id)
+	}
+	return v, true, nil
+}
+
+func putVolume(t storage.Transactor, id string, v volume) error {
+	bkt, err := volumesBucket(t, true)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode volume record %s", id)
+	}
+	return bkt.Put([]byte(id), data)
+}
+
+func deleteVolume(t storage.Transactor, id string) error {
+	bkt, err := volumesBucket(t, false)
+	if err != nil || bkt == nil {
+		return err
+	}
+	return bkt.Delete([]byte(id))
+}
+
+// keyInUse tells whether any volume is still encrypted with the given key
+func keyInUse(t storage.Transactor, keyID string) (bool, error) {
+	bkt, err := volumesBucket(t, false)
+	if err != nil || bkt == nil {
+		return false, err
+	}
+	inUse := false
+	err = bkt.ForEach(func(k, data []byte) error {
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return errors.Wrapf(err, "failed to decode volume record %s", k)
+		}
+		if v.Encrypted && v.KeyID == keyID {
+			inUse = true
+		}
+		return nil
+	})
+	return inUse, err
+}
+
+// keyShared tells whether volumes other than the one with the given ID are
+// encrypted with the given key
+func keyShared(t storage.Transactor, keyID string, id string) (bool, error) {
+	bkt, err := volumesBucket(t, false)
+	if err != nil || bkt == nil {
+		return false, err
+	}
+	shared := false
+	err = bkt.ForEach(func(k, data []byte) error {
+		if string(k) == id {
+			return nil
+		}
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return errors.Wrapf(err, "failed to decode volume record %s", k)
+		}
+		if v.Encrypted && v.KeyID == keyID {
+			shared = true
+		}
+		return nil
+	})
+	return shared, err
+}
+
+// verityViews returns the number of views served from the verity device of
+// the volume with the given ID
+func verityViews(t storage.Transactor, id string) (int, error) {
+	bkt, err := volumesBucket(t, false)
+	if err != nil || bkt == nil {
+		return 0, err
+	}
+	views := 0
+	err = bkt.ForEach(func(k, data []byte) error {
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return errors.Wrapf(err, "failed to decode volume record %s", k)
+		}
+		if v.VerityOf == id {
+			views++
+		}
+		return nil
+	})
+	return views, err
+}
+
+// volumeIDs returns the IDs of all volume records
+func volumeIDs(t storage.Transactor) ([]string, error) {
+	bkt, err := volumesBucket(t, false)
+	if err != nil || bkt == nil {
+		return nil, err
+	}
+	var ids []string
+	err = bkt.ForEach(func(k, _ []byte) error {
+		ids = append(ids, string(k))
+		return nil
+	})
+	return ids, err
+}
+
+// intent is the record of a multi-step operation on the volume of a snapshot,
+// keyed by the snapshot ID. It is written before the operation touches the
+// volume and deleted along with the metadata change completing it, so the
+// operations interrupted by a crash are found on the next start.
+type intent struct {
+	// Op is the operation, one of the intent constants
+	Op string `json:"op"`
+
+	// Key is the key of the snapshot and Name the name it is committed to
+	Key  string `json:"key"`
+	Name string `json:"name,omitempty"`
+
+	// Size is the size a volume is resized to
+	Size uint64 `json:"size,omitempty"`
+
+	// Volume is the volume the operation works on
+	Volume volume `json:"volume"`
+}
+
+func putIntent(t storage.Transactor, id string, in intent) error {
+	bkt, err := lvmBucket(t, bucketKeyIntents, true)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode intent record %s", id)
+	}
+	return bkt.Put([]byte(id), data)
+}
+
+func deleteIntent(t storage.Transactor, id string) error {
+	bkt, err := lvmBucket(t, bucketKeyIntents, false)
+	if err != nil || bkt == nil {
+		return err
+	}
+	return bkt.Delete([]byte(id))
+}
+
+// intents returns the intent records by snapshot ID
+func intents(t storage.Transactor) (map[string]intent, error) {
+	bkt, err := lvmBucket(t, bucketKeyIntents, false)
+	if err != nil || bkt == nil {
+		return nil, err
+	}
+	records := map[string]intent{}
+	err = bkt.ForEach(func(k, data []byte) error {
+		var in intent
+		if err := json.Unmarshal(data, &in); err != nil {
+			return errors.Wrapf(err, "failed to decode intent record %s", k)
+		}
+		records[string(k)] = in
+		return nil
+	})
+	return records, err
+}
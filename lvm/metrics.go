@@ -0,0 +1,206 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "lvm_snapshotter"
+
+// Operations and commands are observed all the time, they only become visible
+// once registered with RegisterMetrics.
+var (
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of snapshotter operations by method and status.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"method", "status"})
+
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_errors_total",
+		Help:      "Number of failed snapshotter operations by method.",
+	}, []string{"method"})
+
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_duration_seconds",
+		Help:      "Duration of the external commands run, retries included, by command and status.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"command", "status"})
+
+	commandRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_retries_total",
+		Help:      "Number of times external commands were retried after failing.",
+	}, []string{"command"})
+)
+
+func status(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// observeOperation records the duration and outcome of a snapshotter method.
+// It is deferred with a pointer to the named error of the method.
+func observeOperation(method string, start time.Time, err *error) {
+	operationDuration.WithLabelValues(method, status(*err)).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		operationErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func observeCommand(cmd string, start time.Time, retries int, err error) {
+	commandDuration.WithLabelValues(cmd, status(err)).Observe(time.Since(start).Seconds())
+	if retries > 0 {
+		commandRetries.WithLabelValues(cmd).Add(float64(retries))
+	}
+}
+
+var (
+	poolSizeDesc = prometheus.NewDesc(metricsNamespace+"_pool_size_bytes",
+		"Size of the data area of the thin pool.", []string{"pool"}, nil)
+	poolDataDesc = prometheus.NewDesc(metricsNamespace+"_pool_data_used_ratio",
+		"Share of the data area of the thin pool in use.", []string{"pool"}, nil)
+	poolMetadataDesc = prometheus.NewDesc(metricsNamespace+"_pool_metadata_used_ratio",
+		"Share of the metadata area of the thin pool in use.", []string{"pool"}, nil)
+	poolUpDesc = prometheus.NewDesc(metricsNamespace+"_pool_up",
+		"Whether the thin pool could be queried and is healthy.", []string{"pool"}, nil)
+	snapshotsDesc = prometheus.NewDesc(metricsNamespace+"_snapshots",
+		"Number of snapshots by kind.", []string{"kind"}, nil)
+	devicesDesc = prometheus.NewDesc(metricsNamespace+"_active_devices",
+		"Number of active device mapper devices by type.", []string{"type"}, nil)
+)
+
+// stateCollector reports the state of the pools and snapshots when scraped
+type stateCollector struct {
+	sn *snapshotter
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{poolSizeDesc, poolDataDesc, poolMetadataDesc, poolUpDesc, snapshotsDesc, devicesDesc} {
+		ch <- d
+	}
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := withPriority(context.Background(), priorityBackground)
+
+	pools, _ := c.sn.PoolStatus(ctx)
+	for _, p := range pools {
+		up := 0.0
+		if p.Error == "" && p.Health == "" {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(poolUpDesc, prometheus.GaugeValue, up, p.Name)
+		if p.Error != "" {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(poolSizeDesc, prometheus.GaugeValue, float64(p.Size), p.Name)
+		ch <- prometheus.MustNewConstMetric(poolDataDesc, prometheus.GaugeValue, p.DataPercent/100, p.Name)
+		ch <- prometheus.MustNewConstMetric(poolMetadataDesc, prometheus.GaugeValue, p.MetadataPercent/100, p.Name)
+	}
+
+	kinds := map[snapshots.Kind]int{snapshots.KindActive: 0, snapshots.KindView: 0, snapshots.KindCommitted: 0}
+	if err := c.sn.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		kinds[info.Kind]++
+		return nil
+	}); err != nil {
+		log.G(ctx).WithError(err).Warn("Unable to count snapshots")
+	} else {
+		for kind, n := range kinds {
+			ch <- prometheus.MustNewConstMetric(snapshotsDesc, prometheus.GaugeValue, float64(n), kind.String())
+		}
+	}
+
+	devices, err := c.sn.activeDevices(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("Unable to count active devices")
+		return
+	}
+	for kind, n := range devices {
+		ch <- prometheus.MustNewConstMetric(devicesDesc, prometheus.GaugeValue, float64(n), kind)
+	}
+}
+
+// activeDevices counts the device mapper devices of the volume groups of the
+// snapshotter, the thin volumes and the crypt and verity mappings on them
+func (o *snapshotter) activeDevices(ctx context.Context) (map[string]int, error) {
+	devices := map[string]int{"thin": 0, "crypt": 0, "verity": 0}
+	entries, err := ioutil.ReadDir("/dev/mapper")
+	if err != nil {
+		return nil, err
+	}
+	vgs := map[string]bool{}
+	for _, p := range o.pools {
+		vgs[p.VgName] = true
+	}
+	for _, e := range entries {
+		name := e.Name()
+		// LVM doubles the dashes of volume names in device names, which
+		// tells hash volumes apart from verity mappings.
+		if strings.HasSuffix(name, "--verity") {
+			continue
+		}
+		for vg := range vgs {
+			if !strings.HasPrefix(name, vg+"-") {
+				continue
+			}
+			switch {
+			case strings.HasSuffix(name, "-crypt"):
+				devices["crypt"]++
+			case strings.HasSuffix(name, "-verity"):
+				devices["verity"]++
+			}
+		}
+	}
+	for _, p := range o.pools {
+		n, err := activeThinVolumes(ctx, p.VgName, p.ThinPool)
+		if err != nil {
+			return nil, err
+		}
+		devices["thin"] += n
+	}
+	return devices, nil
+}
+
+// RegisterMetrics registers the metrics of the snapshotter with the registry
+func RegisterMetrics(reg prometheus.Registerer, sn Snapshotter) error {
+	collectors := []prometheus.Collector{operationDuration, operationErrors, commandDuration, commandRetries, schedulerQueued, schedulerRunning, schedulerWait}
+	if o, ok := sn.(*snapshotter); ok {
+		collectors = append(collectors, &stateCollector{sn: o})
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
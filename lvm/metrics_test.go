@@ -0,0 +1,48 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestCommandMetrics(t *testing.T) {
+	_, err := execCommand(context.Background(), "true", nil, nil, 3)
+	assert.NilError(t, err)
+	assert.Equal(t, testutil.ToFloat64(commandRetries.WithLabelValues("true")), 0.0)
+
+	_, err = execCommand(context.Background(), "false", nil, nil, 3)
+	assert.Assert(t, err != nil)
+	assert.Equal(t, testutil.ToFloat64(commandRetries.WithLabelValues("false")), 2.0)
+}
+
+func TestOperationMetrics(t *testing.T) {
+	before := testutil.ToFloat64(operationErrors.WithLabelValues("test"))
+	err := errors.New("failed")
+	observeOperation("test", time.Now(), &err)
+	err = nil
+	observeOperation("test", time.Now(), &err)
+	assert.Equal(t, testutil.ToFloat64(operationErrors.WithLabelValues("test")), before+1)
+}
@@ -0,0 +1,184 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+// States of a volume record while the device work of an operation runs
+// outside of metadata transactions
+const (
+	// volumeCreating marks the volume of a reserved snapshot, which is not
+	// usable until the volume is built and its record published
+	volumeCreating = "creating"
+	// volumeRemoving marks the record of a removed snapshot whose volume is
+	// being torn down
+	volumeRemoving = "removing"
+)
+
+// volumeLocks serializes the device work on the volumes of snapshots, which
+// runs outside of metadata transactions. Locks are only ever waited for
+// without holding a write transaction, as their holder may be waiting for
+// one. A snapshot is locked before the volume of its parent.
+type volumeLocks struct {
+	mu   sync.Mutex
+	held map[string]chan struct{}
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{held: map[string]chan struct{}{}}
+}
+
+// lock waits for the volume with the given ID to be free and returns the
+// function releasing it
+func (l *volumeLocks) lock(ctx context.Context, id string) (func(), error) {
+	for {
+		if unlock, ok := l.tryLock(id); ok {
+			return unlock, nil
+		}
+		l.mu.Lock()
+		released, ok := l.held[id]
+		l.mu.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryLock locks the volume with the given ID if it is free
+func (l *volumeLocks) tryLock(id string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.held[id]; ok {
+		return nil, false
+	}
+	released := make(chan struct{})
+	l.held[id] = released
+	return func() {
+		l.mu.Lock()
+		delete(l.held, id)
+		l.mu.Unlock()
+		close(released)
+	}, true
+}
+
+// reserve locks the volume of a newly reserved snapshot, which nobody else
+// can know about yet
+func (l *volumeLocks) reserve(id string) (func(), error) {
+	unlock, ok := l.tryLock(id)
+	if !ok {
+		return nil, errors.Wrapf(errdefs.ErrUnavailable, "volume %s is locked", id)
+	}
+	return unlock, nil
+}
+
+// busy tells whether an operation is working on the volume
+func (l *volumeLocks) busy(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.held[id]
+	return ok
+}
+
+// withTransaction runs f in a metadata transaction, which is committed when f
+// succeeds on a writable transaction and rolled back otherwise
+func (o *snapshotter) withTransaction(ctx context.Context, writable bool, f func(ctx context.Context, t storage.Transactor) error) error {
+	ctx, t, err := o.transaction(ctx, writable)
+	if err != nil {
+		return err
+	}
+	if err := f(ctx, t); err != nil || !writable {
+		if rerr := t.Rollback(); rerr != nil {
+			log.G(ctx).WithError(rerr).Warn("Failed to rollback transaction")
+		}
+		return err
+	}
+	return t.Commit()
+}
+
+// lockSnapshot locks the volume of the snapshot key and returns its ID
+func (o *snapshotter) lockSnapshot(ctx context.Context, key string) (string, func(), error) {
+	for {
+		id, err := o.snapshotID(ctx, key)
+		if err != nil {
+			return "", nil, err
+		}
+		unlock, err := o.locks.lock(ctx, id)
+		if err != nil {
+			return "", nil, err
+		}
+		// The key may have been committed or removed, and created again,
+		// while waiting
+		current, err := o.snapshotID(ctx, key)
+		if err == nil && current == id {
+			return id, unlock, nil
+		}
+		unlock()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// lockParent locks the volume of the parent of the snapshot key, if it has
+// one. The parent can not go away while the snapshot exists.
+func (o *snapshotter) lockParent(ctx context.Context, key string) (func(), error) {
+	var pid string
+	if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		s, err := storage.GetSnapshot(ctx, key)
+		if err == nil && len(s.ParentIDs) > 0 {
+			pid = s.ParentIDs[0]
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if pid == "" {
+		return func() {}, nil
+	}
+	return o.locks.lock(ctx, pid)
+}
+
+func (o *snapshotter) snapshotID(ctx context.Context, key string) (id string, err error) {
+	err = o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		id, _, _, err = storage.GetInfo(ctx, key)
+		return err
+	})
+	return id, err
+}
+
+// checkReady fails for snapshots whose volume is not built yet
+func checkReady(vol volume, key string) error {
+	if vol.State == volumeCreating {
+		return errors.Wrapf(errdefs.ErrUnavailable, "snapshot %q is being created", key)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"gotest.tools/assert"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	l := newVolumeLocks()
+	unlock, ok := l.tryLock("1")
+	assert.Assert(t, ok)
+	assert.Assert(t, l.busy("1"))
+	assert.Assert(t, !l.busy("2"))
+	_, ok = l.tryLock("1")
+	assert.Assert(t, !ok)
+	_, err := l.reserve("1")
+	assert.Assert(t, errdefs.IsUnavailable(err))
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := l.lock(context.Background(), "1")
+		assert.NilError(t, err)
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Lock taken while held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	(<-locked)()
+	assert.Assert(t, !l.busy("1"))
+}
+
+func TestVolumeLocksCancel(t *testing.T) {
+	l := newVolumeLocks()
+	unlock, _ := l.tryLock("1")
+	defer unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := l.lock(ctx, "1")
+	assert.Equal(t, err, context.Canceled)
+}
+
+func TestCheckReady(t *testing.T) {
+	assert.NilError(t, checkReady(volume{}, "key"))
+	assert.NilError(t, checkReady(volume{State: volumeRemoving}, "key"))
+	err := checkReady(volume{State: volumeCreating}, "key")
+	assert.Assert(t, errdefs.IsUnavailable(err))
+}
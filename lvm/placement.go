@@ -0,0 +1,103 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// LabelTier requests a base volume to be placed in a pool of the given tier
+const LabelTier = "containerd.io/snapshot/lvm.tier"
+
+// placementPolicy picks the pool a new base volume is created in. Volumes
+// with a parent always stay in the pool of their parent.
+type placementPolicy interface {
+	pick(ctx context.Context, pools []PoolConfig) (PoolConfig, error)
+}
+
+func newPlacementPolicy(policy string) placementPolicy {
+	switch policy {
+	case PolicyRoundRobin:
+		return &roundRobin{}
+	default:
+		return &mostFree{freeSpace: poolFreeSpace}
+	}
+}
+
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (r *roundRobin) pick(ctx context.Context, pools []PoolConfig) (PoolConfig, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := pools[r.next%len(pools)]
+	r.next++
+	return p, nil
+}
+
+type mostFree struct {
+	freeSpace func(ctx context.Context, vgname, lvpoolname string) (uint64, error)
+}
+
+func (m *mostFree) pick(ctx context.Context, pools []PoolConfig) (PoolConfig, error) {
+	var (
+		best     PoolConfig
+		bestFree uint64
+		found    bool
+	)
+	for _, p := range pools {
+		free, err := m.freeSpace(ctx, p.VgName, p.ThinPool)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("Skipping pool %s", p.Name)
+			continue
+		}
+		if !found || free > bestFree {
+			best, bestFree, found = p, free, true
+		}
+	}
+	if !found {
+		return PoolConfig{}, errors.New("no usable pool found")
+	}
+	return best, nil
+}
+
+// candidatePools filters the pools down to those of the requested tier. An
+// empty tier matches every pool.
+func candidatePools(pools []PoolConfig, tier string) ([]PoolConfig, error) {
+	if tier == "" {
+		return pools, nil
+	}
+	var candidates []PoolConfig
+	for _, p := range pools {
+		if p.Tier == tier {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "no pool configured for tier %q", tier)
+	}
+	return candidates, nil
+}
@@ -0,0 +1,78 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+)
+
+var testPools = []PoolConfig{
+	{Name: "a", VgName: "vga", ThinPool: "poola", Tier: "ssd"},
+	{Name: "b", VgName: "vgb", ThinPool: "poolb", Tier: "hdd"},
+	{Name: "c", VgName: "vgc", ThinPool: "poolc", Tier: "ssd"},
+}
+
+func TestRoundRobinPlacement(t *testing.T) {
+	ctx := context.Background()
+	p := newPlacementPolicy(PolicyRoundRobin)
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		pool, err := p.pick(ctx, testPools)
+		assert.NilError(t, err)
+		picked = append(picked, pool.Name)
+	}
+	assert.DeepEqual(t, picked, []string{"a", "b", "c", "a"})
+}
+
+func TestMostFreePlacement(t *testing.T) {
+	ctx := context.Background()
+	free := map[string]uint64{"vga": 10, "vgb": 30, "vgc": 20}
+	p := &mostFree{freeSpace: func(ctx context.Context, vgname, lvpoolname string) (uint64, error) {
+		if vgname == "vgb" {
+			return 0, errors.New("pool gone")
+		}
+		return free[vgname], nil
+	}}
+
+	pool, err := p.pick(ctx, testPools)
+	assert.NilError(t, err)
+	assert.Equal(t, pool.Name, "c")
+
+	_, err = p.pick(ctx, testPools[1:2])
+	assert.Error(t, err, "no usable pool found")
+}
+
+func TestCandidatePools(t *testing.T) {
+	pools, err := candidatePools(testPools, "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(pools), 3)
+
+	pools, err = candidatePools(testPools, "ssd")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pools, []PoolConfig{testPools[0], testPools[2]})
+
+	_, err = candidatePools(testPools, "nvme")
+	assert.Assert(t, errdefs.IsInvalidArgument(err))
+}
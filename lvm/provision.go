@@ -0,0 +1,229 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DiscardsIgnore makes the pool ignore discards
+	DiscardsIgnore = "ignore"
+	// DiscardsNoPassdown frees discarded chunks in the pool without passing
+	// the discards down to the devices backing it
+	DiscardsNoPassdown = "nopassdown"
+	// DiscardsPassdown frees discarded chunks and passes the discards down
+	DiscardsPassdown = "passdown"
+
+	defaultPoolExtents = "90%FREE"
+)
+
+var extentsRe = regexp.MustCompile(`^[0-9]+%(FREE|VG|PVS)$`)
+
+// ThinPoolOptions control how a thin pool is created. Empty fields leave the
+// choice to LVM.
+type ThinPoolOptions struct {
+	// DataSize is either a size like "100G" or a share of the volume group
+	// like "90%FREE" (If empty, 90%FREE will be used)
+	DataSize     string
+	MetadataSize string
+	ChunkSize    string
+
+	// Zero zeroes the first block of newly provisioned chunks
+	Zero bool
+
+	// Discards is the discard mode of the pool, either ignore, nopassdown
+	// or passdown
+	Discards string
+}
+
+// ProvisionConfig describes the volume group and thin pool to provision
+type ProvisionConfig struct {
+	VgName   string
+	ThinPool string
+
+	// Devices are the block devices of the volume group
+	Devices []string
+
+	// LoopFile is a sparse file of LoopSize bytes backing the volume group
+	// through a loop device, instead of Devices
+	LoopFile string
+	LoopSize string
+
+	Pool ThinPoolOptions
+}
+
+// Validate checks the provisioning configuration
+func (p *ProvisionConfig) Validate() error {
+	if p.VgName == "" || p.ThinPool == "" {
+		return errors.New("Need both a volume group and a thin pool name")
+	}
+	if (len(p.Devices) == 0) == (p.LoopFile == "") {
+		return errors.New("Need either block devices or a loop file")
+	}
+	if p.LoopFile != "" {
+		if p.LoopSize == "" {
+			return errors.New("Need the size of the loop file")
+		}
+		if _, err := units.RAMInBytes(p.LoopSize); err != nil {
+			return errors.Wrapf(err, "invalid loop file size")
+		}
+	}
+	if p.Pool.DataSize != "" && !extentsRe.MatchString(p.Pool.DataSize) {
+		if _, err := units.RAMInBytes(p.Pool.DataSize); err != nil {
+			return errors.Wrapf(err, "invalid data size")
+		}
+	}
+	for name, size := range map[string]string{"metadata size": p.Pool.MetadataSize, "chunk size": p.Pool.ChunkSize} {
+		if size == "" {
+			continue
+		}
+		if _, err := units.RAMInBytes(size); err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+	}
+	switch p.Pool.Discards {
+	case "", DiscardsIgnore, DiscardsNoPassdown, DiscardsPassdown:
+	default:
+		return errors.Errorf("Unsupported discards mode %q, use %q, %q or %q", p.Pool.Discards, DiscardsIgnore, DiscardsNoPassdown, DiscardsPassdown)
+	}
+	return nil
+}
+
+// thinPoolArgs returns the lvcreate arguments creating the thin pool
+func thinPoolArgs(vgname string, lvpool string, opts ThinPoolOptions) []string {
+	args := []string{"--type", "thin-pool", "--name", lvpool}
+	size := opts.DataSize
+	if size == "" {
+		size = defaultPoolExtents
+	}
+	if extentsRe.MatchString(size) {
+		args = append(args, "--extents", size)
+	} else {
+		args = append(args, "--size", bytesArg(size))
+	}
+	if opts.MetadataSize != "" {
+		args = append(args, "--poolmetadatasize", bytesArg(opts.MetadataSize))
+	}
+	if opts.ChunkSize != "" {
+		args = append(args, "--chunksize", bytesArg(opts.ChunkSize))
+	}
+	zero := "n"
+	if opts.Zero {
+		zero = "y"
+	}
+	args = append(args, "--zero", zero)
+	if opts.Discards != "" {
+		args = append(args, "--discards", opts.Discards)
+	}
+	return append(args, vgname)
+}
+
+// bytesArg converts a validated size into an LVM argument in bytes
+func bytesArg(size string) string {
+	n, _ := units.RAMInBytes(size)
+	return strconv.FormatInt(n, 10) + "b"
+}
+
+// Provision creates the volume group and thin pool of the configuration.
+// Whatever already exists is left as it is, so it can be run repeatedly.
+func Provision(ctx context.Context, p ProvisionConfig) error {
+	devices := p.Devices
+	if p.LoopFile != "" {
+		// Loop devices do not survive a reboot, the file is attached
+		// again so the volume group on it shows up.
+		device, err := attachLoopFile(ctx, p.LoopFile, p.LoopSize)
+		if err != nil {
+			return err
+		}
+		devices = []string{device}
+	}
+
+	if _, err := checkVG(ctx, p.VgName); err != nil {
+		log.G(ctx).Infof("Creating volume group %s on %s", p.VgName, strings.Join(devices, ", "))
+		if out, err := createVolumeGroup(ctx, strings.Join(devices, " "), p.VgName); err != nil {
+			return errors.Wrapf(err, "Unable to create volume group %s: %s", p.VgName, out)
+		}
+	} else {
+		log.G(ctx).Infof("Volume group %s already exists", p.VgName)
+	}
+
+	if _, err := checkLV(ctx, p.VgName, p.ThinPool); err == nil {
+		log.G(ctx).Infof("Thin pool %s/%s already exists", p.VgName, p.ThinPool)
+		return nil
+	}
+	log.G(ctx).Infof("Creating thin pool %s/%s", p.VgName, p.ThinPool)
+	if out, err := createLogicalThinPool(ctx, p.VgName, p.ThinPool, p.Pool); err != nil {
+		return errors.Wrapf(err, "Unable to create thin pool %s/%s: %s", p.VgName, p.ThinPool, out)
+	}
+	return nil
+}
+
+// attachLoopFile creates the sparse file if needed and returns the loop
+// device backing it, setting one up unless it exists
+func attachLoopFile(ctx context.Context, path string, size string) (string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		n, _ := units.RAMInBytes(size)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", errors.Wrap(err, "Unable to create loop file directory")
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return "", errors.Wrap(err, "Unable to create loop file")
+		}
+		defer f.Close()
+		if err := f.Truncate(n); err != nil {
+			return "", errors.Wrap(err, "Unable to size loop file")
+		}
+	} else if err != nil {
+		return "", errors.Wrap(err, "Unable to stat loop file")
+	}
+
+	out, err := runCommand(ctx, "losetup", []string{"--associated", path})
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to look up loop device of %s: %s", path, out)
+	}
+	if device := parseLoopDevice(out); device != "" {
+		log.G(ctx).Infof("Reusing loop device %s", device)
+		return device, nil
+	}
+	out, err = runCommand(ctx, "losetup", []string{"--find", "--show", path})
+	if err != nil {
+		return "", errors.Wrapf(err, "Unable to set up loop device for %s: %s", path, out)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// parseLoopDevice returns the first device of "losetup --associated" output
+func parseLoopDevice(output string) string {
+	line := strings.SplitN(strings.TrimSpace(output), "\n", 2)[0]
+	if i := strings.Index(line, ":"); i > 0 {
+		return line[:i]
+	}
+	return ""
+}
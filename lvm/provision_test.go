@@ -0,0 +1,60 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestValidateProvision(t *testing.T) {
+	p := ProvisionConfig{VgName: "vg", ThinPool: "pool", Devices: []string{"/dev/sdc"}}
+	assert.NilError(t, p.Validate())
+
+	p.LoopFile = "/var/lib/lvm.img"
+	assert.ErrorContains(t, p.Validate(), "either block devices or a loop file")
+
+	p.Devices = nil
+	assert.ErrorContains(t, p.Validate(), "size of the loop file")
+
+	p.LoopSize = "20G"
+	p.Pool = ThinPoolOptions{DataSize: "80%VG", MetadataSize: "1G", ChunkSize: "64k", Discards: DiscardsPassdown}
+	assert.NilError(t, p.Validate())
+
+	p.Pool.DataSize = "lots"
+	assert.ErrorContains(t, p.Validate(), "invalid data size")
+
+	p.Pool.DataSize = "10G"
+	p.Pool.Discards = "sometimes"
+	assert.ErrorContains(t, p.Validate(), "Unsupported discards mode")
+}
+
+func TestThinPoolArgs(t *testing.T) {
+	assert.DeepEqual(t, thinPoolArgs("vg", "pool", ThinPoolOptions{}),
+		[]string{"--type", "thin-pool", "--name", "pool", "--extents", "90%FREE", "--zero", "n", "vg"})
+
+	assert.DeepEqual(t, thinPoolArgs("vg", "pool", ThinPoolOptions{DataSize: "10G", MetadataSize: "1G", ChunkSize: "64k", Zero: true, Discards: DiscardsNoPassdown}),
+		[]string{"--type", "thin-pool", "--name", "pool", "--size", "10737418240b", "--poolmetadatasize", "1073741824b", "--chunksize", "65536b", "--zero", "y", "--discards", "nopassdown", "vg"})
+}
+
+func TestParseLoopDevice(t *testing.T) {
+	assert.Equal(t, parseLoopDevice("/dev/loop3: [2049]:1234 (/var/lib/lvm.img)\n"), "/dev/loop3")
+	assert.Equal(t, parseLoopDevice(""), "")
+}
@@ -0,0 +1,79 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+func fstrim(ctx context.Context, mountpoint string) (string, error) {
+	cmd := "fstrim"
+	args := []string{"--verbose", mountpoint}
+	return runCommand(ctx, cmd, args)
+}
+
+func discardDevice(ctx context.Context, device string) (string, error) {
+	cmd := "blkdiscard"
+	args := []string{device}
+	return runCommand(ctx, cmd, args)
+}
+
+// trimVolume returns the blocks freed by the filesystem mounted at root to
+// the thin pool
+func (o *snapshotter) trimVolume(ctx context.Context, root string, vol volume, id string) error {
+	before, err := lvUsedSpace(ctx, vol.VgName, id)
+	if err != nil {
+		return err
+	}
+	if out, err := fstrim(ctx, root); err != nil {
+		return errors.Wrapf(err, "fstrim failed: %s", out)
+	}
+	after, err := lvUsedSpace(ctx, vol.VgName, id)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).WithField("pool", vol.Pool).Infof("Trimmed volume %s: %d bytes mapped before, %d after, %d reclaimed", id, before, after, before-after)
+	return nil
+}
+
+// discardVolume unmaps every block of the volume before it is removed. The
+// logical volume is discarded rather than the crypt device on top of it, as
+// dm-crypt drops discards unless told otherwise.
+func (o *snapshotter) discardVolume(ctx context.Context, vol volume, id string) error {
+	if _, err := toggleactivateLV(ctx, vol.VgName, id, true); err != nil {
+		return errors.Wrap(err, "Unable to activate volume")
+	}
+	before, err := poolFreeSpace(ctx, vol.VgName, vol.ThinPool)
+	if err != nil {
+		return err
+	}
+	if out, err := discardDevice(ctx, filepath.Join("/dev", vol.VgName, id)); err != nil {
+		return errors.Wrapf(err, "blkdiscard failed: %s", out)
+	}
+	after, err := poolFreeSpace(ctx, vol.VgName, vol.ThinPool)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).WithField("pool", vol.Pool).Infof("Discarded volume %s: %d bytes free in pool before, %d after, %d reclaimed", id, before, after, int64(after)-int64(before))
+	return nil
+}
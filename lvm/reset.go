@@ -0,0 +1,207 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// resetLVName returns the name the replacement volume of a reset is built
+// under before it takes the place of the original one
+func resetLVName(lvname string) string {
+	return lvname + "-reset"
+}
+
+// Reset throws away the changes made in the active snapshot key and brings it
+// back to the state of its parent, or to an empty filesystem if it has none.
+// The volume is replaced by a fresh one under the same name, so the key,
+// labels, ID and device path of the snapshot stay the same. A snapshot that
+// is still mounted is only reset under the lazy-unmount busy policy, which
+// detaches its mounts, and refused otherwise.
+func (o *snapshotter) Reset(ctx context.Context, key string) (_ []mount.Mount, err error) {
+	ctx, span := startSpan(ctx, "lvm.Reset", attribute.String("snapshot.key", key))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	log.G(ctx).Debugf("Reset snapshot %s", key)
+	_, unlock, err := o.lockSnapshot(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	unlockParent, err := o.lockParent(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockParent()
+
+	// The metadata does not change, the volume is replaced under its name
+	var (
+		s         storage.Snapshot
+		vol       volume
+		parentVol volume
+		views     int
+	)
+	if err = o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		var err error
+		if s, err = storage.GetSnapshot(ctx, key); err != nil {
+			return err
+		}
+		if s.Kind != snapshots.KindActive {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition, "snapshot %q is not active", key)
+		}
+		if vol, err = o.volume(t, s.ID); err != nil {
+			return err
+		}
+		if err = checkReady(vol, key); err != nil {
+			return err
+		}
+		if len(s.ParentIDs) == 0 {
+			return nil
+		}
+		if parentVol, err = o.volume(t, s.ParentIDs[0]); err != nil {
+			return err
+		}
+		if parentVol.VerityHash != "" {
+			views, err = verityViews(t, s.ParentIDs[0])
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	ctx = withSnapshotID(ctx, s.ID)
+
+	if err = o.recordIntent(ctx, s.ID, intent{Op: intentReset, Key: key, Volume: vol}); err != nil {
+		return nil, err
+	}
+	// The volume is left alone when the reset fails before it is deleted,
+	// from then on the reset is completed by the recovery of the intent.
+	var (
+		undo     undoStack
+		replaced bool
+	)
+	defer func() {
+		if err != nil && !replaced && undo.run(ctx) {
+			o.clearIntent(ctx, s.ID)
+		}
+	}()
+
+	// The replacement is built next to the volume, which is only touched
+	// once the replacement is complete.
+	tmp := resetLVName(s.ID)
+	if err = o.rebuildVolume(ctx, s, vol, parentVol, views, tmp, &undo); err != nil {
+		return nil, errors.Wrap(err, "Unable to reset volume")
+	}
+
+	// Mounts of the snapshot still around are refused or lazily detached,
+	// depending on the policy
+	if _, err = o.releaseDevice(ctx, key, o.getSnapshotDir(vol, s.ID), false); err != nil {
+		return nil, errors.Wrap(err, "Unable to release volume")
+	}
+	if err = o.deactivateVolume(ctx, vol, s.ID); err != nil {
+		return nil, errors.Wrap(err, "Unable to deactivate volume")
+	}
+	undo.push("reactivate volume", func(ctx context.Context) error {
+		return o.activateVolume(ctx, vol, s.ID)
+	})
+	if out, err := removeLVMVolume(ctx, vol.VgName, s.ID); err != nil {
+		return nil, errors.Wrapf(err, "Unable to delete volume: %s", out)
+	}
+	replaced = true
+	if out, err := renameLVMVolume(ctx, vol.VgName, tmp, s.ID); err != nil {
+		return nil, errors.Wrapf(err, "Unable to rename replacement volume %s: %s", tmp, out)
+	}
+	if err = o.activateVolume(ctx, vol, s.ID); err != nil {
+		return nil, errors.Wrap(err, "Unable to activate volume")
+	}
+	o.clearIntent(ctx, s.ID)
+	return o.mounts(s, vol), nil
+}
+
+// rebuildVolume creates the logical volume lvname with the contents of the
+// parent of the snapshot, described by parentVol and its number of views,
+// and leaves it deactivated. Deleting the volume is pushed to undo.
+func (o *snapshotter) rebuildVolume(ctx context.Context, s storage.Snapshot, vol, parentVol volume, views int, lvname string, undo *undoStack) error {
+	var pid string
+	if len(s.ParentIDs) > 0 {
+		pid = s.ParentIDs[0]
+		if parentVol.VerityHash != "" {
+			if err := o.verifyVolume(ctx, views, parentVol, pid); err != nil {
+				return errors.Wrapf(errdefs.ErrFailedPrecondition, "parent is corrupted: %v", err)
+			}
+		}
+		if parentVol.Pool == vol.Pool {
+			// Snapshots of an encrypted parent share its LUKS header
+			if out, err := createLVMVolume(ctx, lvname, vol.VgName, vol.ThinPool, o.config.ImageSize, pid, snapshots.KindActive); err != nil {
+				return errors.Wrapf(err, "Unable to create volume: %s", out)
+			}
+			undo.push("delete replacement volume", func(ctx context.Context) error {
+				_, err := removeLVMVolume(ctx, vol.VgName, lvname)
+				return err
+			})
+			return nil
+		}
+	}
+
+	// Base volumes and copies of parents from other pools start from an
+	// empty filesystem. They are encrypted with the key the volume already
+	// uses, which checkpoints and clones of the volume depend on.
+	if out, err := createLVMVolume(ctx, lvname, vol.VgName, vol.ThinPool, o.config.ImageSize, "", snapshots.KindActive); err != nil {
+		return errors.Wrapf(err, "Unable to create volume: %s", out)
+	}
+	undo.push("delete replacement volume", func(ctx context.Context) error {
+		_, err := removeLVMVolume(ctx, vol.VgName, lvname)
+		return err
+	})
+	if _, err := toggleactivateLV(ctx, vol.VgName, lvname, true); err != nil {
+		return err
+	}
+	undo.push("deactivate replacement volume", func(ctx context.Context) error {
+		return o.deactivateVolume(ctx, vol, lvname)
+	})
+	if vol.Encrypted {
+		key, err := o.keys.get(vol.KeyID)
+		if err != nil {
+			return err
+		}
+		if out, err := luksFormat(ctx, vol.VgName, lvname, key); err != nil {
+			return errors.Wrapf(err, "luksFormat failed: %s", out)
+		}
+	}
+	if err := o.openVolume(ctx, vol, lvname); err != nil {
+		return err
+	}
+	if err := formatDevice(ctx, o.getSnapshotDir(vol, lvname), o.config.FsType); err != nil {
+		return err
+	}
+	if pid != "" {
+		if err := o.cloneVolume(ctx, parentVol, pid, vol, lvname); err != nil {
+			return err
+		}
+	}
+	o.removeLostFound(ctx, o.mounts(storage.Snapshot{ID: lvname, Kind: snapshots.KindActive}, vol))
+	return o.deactivateVolume(ctx, vol, lvname)
+}
@@ -0,0 +1,230 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultLVMConcurrency  = 4
+	defaultMkfsConcurrency = 2
+)
+
+// priority orders the commands waiting for a slot. Commands of a higher
+// priority always run first, in the order they were queued.
+type priority int
+
+const (
+	priorityBackground priority = iota
+	priorityNormal
+	priorityInteractive
+)
+
+func (p priority) String() string {
+	switch p {
+	case priorityBackground:
+		return "background"
+	case priorityInteractive:
+		return "interactive"
+	default:
+		return "normal"
+	}
+}
+
+type priorityKey struct{}
+
+// withPriority sets the priority of the commands run on behalf of the context
+func withPriority(ctx context.Context, p priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityOf(ctx context.Context) priority {
+	if p, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return p
+	}
+	return priorityNormal
+}
+
+var (
+	schedulerQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "scheduler_queued_commands",
+		Help:      "Number of commands waiting for a slot by class and priority.",
+	}, []string{"class", "priority"})
+
+	schedulerRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "scheduler_running_commands",
+		Help:      "Number of commands holding a slot by class.",
+	}, []string{"class"})
+
+	schedulerWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "scheduler_wait_seconds",
+		Help:      "Time commands waited for a slot by class and priority.",
+		Buckets:   []float64{.001, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"class", "priority"})
+)
+
+// Classes of commands limited by the scheduler
+const (
+	classLVM  = "lvm"
+	classMkfs = "mkfs"
+)
+
+// commandClass returns the class of a command, or an empty string for
+// commands that are not limited
+func commandClass(cmd string) string {
+	switch {
+	case strings.HasPrefix(cmd, "mkfs"):
+		return classMkfs
+	case strings.HasPrefix(cmd, "lv"), strings.HasPrefix(cmd, "vg"), strings.HasPrefix(cmd, "pv"):
+		// The LVM tools serialize on a global lock, running many of them
+		// at once only adds contention.
+		return classLVM
+	}
+	return ""
+}
+
+// slots bounds the number of commands of a class running at once
+type slots struct {
+	class  string
+	mu     sync.Mutex
+	limit  int
+	active int
+	queues [priorityInteractive + 1][]chan struct{}
+}
+
+// acquire waits for a slot and returns the function releasing it. A limit of
+// zero does not bound the class.
+func (s *slots) acquire(ctx context.Context, p priority) (func(), error) {
+	start := time.Now()
+	s.mu.Lock()
+	if s.limit <= 0 || (s.active < s.limit && s.waiting() == 0) {
+		s.active++
+		s.mu.Unlock()
+		s.observe(p, start)
+		return s.release, nil
+	}
+	ready := make(chan struct{})
+	s.queues[p] = append(s.queues[p], ready)
+	schedulerQueued.WithLabelValues(s.class, p.String()).Inc()
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		s.observe(p, start)
+		return s.release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, c := range s.queues[p] {
+			if c == ready {
+				s.queues[p] = append(s.queues[p][:i], s.queues[p][i+1:]...)
+				schedulerQueued.WithLabelValues(s.class, p.String()).Dec()
+				return nil, ctx.Err()
+			}
+		}
+		// The slot was granted in the meantime, pass it on
+		s.active--
+		s.grant()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *slots) observe(p priority, start time.Time) {
+	schedulerRunning.WithLabelValues(s.class).Inc()
+	schedulerWait.WithLabelValues(s.class, p.String()).Observe(time.Since(start).Seconds())
+}
+
+func (s *slots) release() {
+	schedulerRunning.WithLabelValues(s.class).Dec()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.grant()
+}
+
+func (s *slots) waiting() int {
+	n := 0
+	for _, q := range s.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// grant hands free slots to the waiting commands of the highest priority,
+// the caller holds the lock
+func (s *slots) grant() {
+	for p := priorityInteractive; p >= priorityBackground; p-- {
+		for len(s.queues[p]) > 0 && (s.limit <= 0 || s.active < s.limit) {
+			ready := s.queues[p][0]
+			s.queues[p] = s.queues[p][1:]
+			schedulerQueued.WithLabelValues(s.class, p.String()).Dec()
+			s.active++
+			close(ready)
+		}
+	}
+}
+
+func (s *slots) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.grant()
+}
+
+// scheduler bounds the LVM and mkfs commands run at once, separately, so a
+// burst of snapshot operations does not pile up processes contending on the
+// same locks and devices, and lets interactive operations go first
+type scheduler struct {
+	classes map[string]*slots
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{classes: map[string]*slots{
+		classLVM:  {class: classLVM},
+		classMkfs: {class: classMkfs},
+	}}
+}
+
+// commandScheduler schedules the commands of all snapshotters of the process,
+// which share the same LVM lock
+var commandScheduler = newScheduler()
+
+func (s *scheduler) configure(c SchedulerConfig) {
+	s.classes[classLVM].setLimit(c.LVMConcurrency)
+	s.classes[classMkfs].setLimit(c.MkfsConcurrency)
+}
+
+// acquire waits for a slot to run the command, with the priority of the
+// context
+func (s *scheduler) acquire(ctx context.Context, cmd string) (func(), error) {
+	sl, ok := s.classes[commandClass(cmd)]
+	if !ok {
+		return func() {}, nil
+	}
+	return sl.acquire(ctx, priorityOf(ctx))
+}
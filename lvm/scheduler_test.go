@@ -0,0 +1,115 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestCommandClass(t *testing.T) {
+	for cmd, class := range map[string]string{
+		"lvcreate":   classLVM,
+		"vgs":        classLVM,
+		"pvcreate":   classLVM,
+		"mkfs.xfs":   classMkfs,
+		"cryptsetup": "",
+		"fsfreeze":   "",
+	} {
+		assert.Equal(t, commandClass(cmd), class, cmd)
+	}
+}
+
+// idle checks that no slot is held anymore
+func idle(t *testing.T, s *slots) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, s.active, 0)
+}
+
+// queued waits until n commands wait for a slot
+func queued(t *testing.T, s *slots, n int) {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		w := s.waiting()
+		s.mu.Unlock()
+		if w == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d queued commands", n)
+}
+
+func TestSlotsPriority(t *testing.T) {
+	s := &slots{class: "test", limit: 1}
+	release, err := s.acquire(context.Background(), priorityNormal)
+	assert.NilError(t, err)
+
+	var wg sync.WaitGroup
+	order := make(chan priority, 3)
+	for i, p := range []priority{priorityBackground, priorityNormal, priorityInteractive} {
+		wg.Add(1)
+		go func(p priority) {
+			defer wg.Done()
+			release, err := s.acquire(context.Background(), p)
+			assert.Check(t, err)
+			order <- p
+			release()
+		}(p)
+		queued(t, s, i+1)
+	}
+
+	release()
+	wg.Wait()
+	assert.Equal(t, <-order, priorityInteractive)
+	assert.Equal(t, <-order, priorityNormal)
+	assert.Equal(t, <-order, priorityBackground)
+	idle(t, s)
+}
+
+func TestSlotsCancel(t *testing.T) {
+	s := &slots{class: "test", limit: 1}
+	release, err := s.acquire(context.Background(), priorityNormal)
+	assert.NilError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.acquire(ctx, priorityInteractive)
+	assert.Equal(t, err, context.DeadlineExceeded)
+	queued(t, s, 0)
+
+	// Raising the limit lets waiting commands through
+	done := make(chan struct{})
+	go func() {
+		release, err := s.acquire(context.Background(), priorityNormal)
+		assert.Check(t, err)
+		release()
+		close(done)
+	}()
+	queued(t, s, 1)
+	s.setLimit(2)
+	<-done
+	release()
+	idle(t, s)
+}
@@ -0,0 +1,167 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/api/types"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	lvmapi "github.com/ganeshmaharaj/lvm-snapshotter/api/services/lvm/v1"
+)
+
+// service serves the LVM gRPC service. It only translates messages, the
+// snapshotter takes care of locking and transactions like it does for the
+// snapshots API.
+type service struct {
+	sn Snapshotter
+}
+
+// FromSnapshotter returns the LVM gRPC service serving the snapshotter
+func FromSnapshotter(sn Snapshotter) lvmapi.LVMServer {
+	return &service{sn: sn}
+}
+
+func (s *service) Info(ctx context.Context, r *lvmapi.InfoRequest) (*lvmapi.InfoResponse, error) {
+	info, err := s.sn.DeviceInfo(ctx, r.Key)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &lvmapi.InfoResponse{Device: lvmapi.DeviceInfo{
+		Pool:           info.Pool,
+		VgName:         info.VgName,
+		LVName:         info.LVName,
+		Device:         info.Device,
+		DMDevice:       info.DMDevice,
+		Major:          info.Major,
+		Minor:          info.Minor,
+		FsUUID:         info.FsUUID,
+		SizeBytes:      info.Size,
+		Active:         info.Active,
+		Encrypted:      info.Encrypted,
+		Block:          info.Block,
+		VerityRootHash: info.VerityRootHash,
+	}}, nil
+}
+
+func (s *service) PoolStatus(ctx context.Context, r *lvmapi.PoolStatusRequest) (*lvmapi.PoolStatusResponse, error) {
+	status, err := s.sn.PoolStatus(ctx)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	resp := &lvmapi.PoolStatusResponse{}
+	for _, p := range status {
+		resp.Pools = append(resp.Pools, lvmapi.Pool{
+			Name:            p.Name,
+			VgName:          p.VgName,
+			ThinPool:        p.ThinPool,
+			Tier:            p.Tier,
+			SizeBytes:       p.Size,
+			DataPercent:     p.DataPercent,
+			MetadataPercent: p.MetadataPercent,
+			Health:          p.Health,
+			Error:           p.Error,
+		})
+	}
+	return resp, nil
+}
+
+func (s *service) Resize(ctx context.Context, r *lvmapi.ResizeRequest) (*lvmapi.ResizeResponse, error) {
+	if err := s.sn.Resize(ctx, r.Key, r.SizeBytes); err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &lvmapi.ResizeResponse{}, nil
+}
+
+func (s *service) Clone(ctx context.Context, r *lvmapi.CloneRequest) (*lvmapi.CloneResponse, error) {
+	mounts, err := s.sn.Clone(ctx, r.Key, r.Source, snapshots.WithLabels(r.Labels))
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &lvmapi.CloneResponse{Mounts: fromMounts(mounts)}, nil
+}
+
+func (s *service) Reset(ctx context.Context, r *lvmapi.ResetRequest) (*lvmapi.ResetResponse, error) {
+	mounts, err := s.sn.Reset(ctx, r.Key)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &lvmapi.ResetResponse{Mounts: fromMounts(mounts)}, nil
+}
+
+func (s *service) Reconcile(ctx context.Context, r *lvmapi.ReconcileRequest) (*lvmapi.ReconcileResponse, error) {
+	report, err := s.sn.Reconcile(ctx, r.Remove)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+	return &lvmapi.ReconcileResponse{
+		OrphanVolumes:  report.OrphanVolumes,
+		MissingVolumes: report.MissingVolumes,
+		StaleRecords:   report.StaleRecords,
+		Removed:        report.Removed,
+	}, nil
+}
+
+func (s *service) Subscribe(r *lvmapi.SubscribeRequest, stream lvmapi.LVM_SubscribeServer) error {
+	events, errs := s.sn.Subscribe(stream.Context(), r.Namespaces...)
+	for ev := range events {
+		if err := stream.Send(toAPIEvent(ev)); err != nil {
+			return err
+		}
+	}
+	return errdefs.ToGRPC(<-errs)
+}
+
+func toAPIEvent(ev Event) *lvmapi.Event {
+	e := &lvmapi.Event{
+		Type:             ev.Type,
+		Timestamp:        ev.Timestamp,
+		Namespace:        ev.Namespace,
+		Name:             ev.Info.Name,
+		Parent:           ev.Info.Parent,
+		Labels:           ev.Info.Labels,
+		ID:               ev.ID,
+		Pool:             ev.Pool,
+		SizeBytes:        ev.Size,
+		DataPercent:      ev.DataPercent,
+		MetadataPercent:  ev.MetadataPercent,
+		ThresholdPercent: ev.Threshold,
+		Above:            ev.Above,
+		Fix:              ev.Fix,
+	}
+	if ev.Info.Name != "" {
+		e.Kind = ev.Info.Kind.String()
+		e.Created, e.Updated = &ev.Info.Created, &ev.Info.Updated
+	}
+	return e
+}
+
+func fromMounts(mounts []mount.Mount) []*types.Mount {
+	out := make([]*types.Mount, len(mounts))
+	for i, m := range mounts {
+		out[i] = &types.Mount{
+			Type:    m.Type,
+			Source:  m.Source,
+			Options: m.Options,
+		}
+	}
+	return out
+}
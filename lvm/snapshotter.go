@@ -23,9 +23,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/plugin"
 	"github.com/containerd/containerd/snapshots"
@@ -33,11 +37,16 @@ import (
 
 	"github.com/containerd/continuity/fs"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	metaVolumeMountName = "contd-lvm-snapshotter-db-holder"
 	metavolume          = "contd-metadata-holder"
+
+	// LabelMountMode selects how a snapshot is handed out, either
+	// filesystem or block, overriding the mount_mode setting
+	LabelMountMode = "containerd.io/snapshot/lvm.mount-mode"
 )
 
 func init() {
@@ -61,43 +70,115 @@ func init() {
 	})
 }
 
+// Snapshotter is a containerd snapshotter with additional operations on the
+// logical volumes backing the snapshots
+type Snapshotter interface {
+	snapshots.Snapshotter
+
+	// Checkpoint captures the current state of an active snapshot into a
+	// new committed snapshot while the active snapshot stays in use.
+	Checkpoint(ctx context.Context, name, key string, opts ...snapshots.Opt) error
+
+	// Clone creates a new active snapshot from the current state of an
+	// existing active snapshot.
+	Clone(ctx context.Context, key, source string, opts ...snapshots.Opt) ([]mount.Mount, error)
+
+	// Reset brings an active snapshot back to the state of its parent,
+	// keeping its key, labels and ID. Mounted snapshots are refused unless
+	// the busy policy lazily detaches their mounts.
+	Reset(ctx context.Context, key string) ([]mount.Mount, error)
+
+	// DeviceInfo returns the details of the device backing a snapshot.
+	DeviceInfo(ctx context.Context, key string) (DeviceInfo, error)
+
+	// PoolStatus returns the state of the thin pools.
+	PoolStatus(ctx context.Context) ([]PoolStatus, error)
+
+	// Resize grows the volume of an active snapshot and its filesystem.
+	Resize(ctx context.Context, key string, size uint64) error
+
+	// Reconcile reports, and optionally removes, logical volumes and
+	// records the metadata and the pools disagree on.
+	Reconcile(ctx context.Context, remove bool) (ReconcileReport, error)
+
+	// InspectMounts activates the volume of a snapshot of any kind and
+	// returns read-only mounts of it.
+	InspectMounts(ctx context.Context, key string) ([]mount.Mount, error)
+
+	// Teardown unmounts and deactivates the volumes of all snapshots.
+	Teardown(ctx context.Context) error
+
+	// Check verifies that the pools and the metadata volume are available.
+	Check(ctx context.Context) error
+
+	// Subscribe returns the lifecycle events of the snapshots of the given
+	// namespaces, of all namespaces when none are given, and of the pools.
+	// The event channel is closed once the context is done or the
+	// subscriber fell behind, the error channel then tells why.
+	Subscribe(ctx context.Context, namespaces ...string) (<-chan Event, <-chan error)
+
+	// CloseEvents ends every subscription with ErrUnavailable and refuses
+	// new ones, before the server stops.
+	CloseEvents()
+}
+
 type snapshotter struct {
 	config      *SnapConfig
 	ms          *storage.MetaStore
 	metaVolPath string
+	pools       []PoolConfig
+	policy      placementPolicy
+	keys        keyProvider
+	hooks       *hooks
+	events      *eventBroker
+	locks       *volumeLocks
+	stopWatch   context.CancelFunc
+
+	// verified holds the IDs of the protected volumes verified since they
+	// were activated
+	verified sync.Map
 }
 
 // NewSnapshotter returns a Snapshotter which copies layers on the underlying
 // file system. A metadata file is stored under the root.
-func NewSnapshotter(ctx context.Context, config *SnapConfig) (snapshots.Snapshotter, error) {
+func NewSnapshotter(ctx context.Context, config *SnapConfig) (Snapshotter, error) {
 	var err error
 
-	if _, err = checkVG(config.VgName); err != nil {
+	commandScheduler.configure(config.Scheduler)
+
+	if _, err = checkVG(ctx, config.VgName); err != nil {
 		return nil, errors.Wrap(err, "VG not found")
 	}
 
-	_, err = checkLV(config.VgName, config.ThinPool)
+	_, err = checkLV(ctx, config.VgName, config.ThinPool)
 	if err != nil {
 		return nil, errors.Wrap(err, "LV not found")
 	}
 
-	_, err = checkLV(config.VgName, metavolume)
+	pools := config.AllPools()
+	for _, p := range pools[1:] {
+		if _, err = checkLV(ctx, p.VgName, p.ThinPool); err != nil {
+			return nil, errors.Wrapf(err, "Pool %s not found", p.Name)
+		}
+	}
+
+	_, err = checkLV(ctx, config.VgName, metavolume)
 	if err != nil {
 		// Create a volume to hold the metadata.db file.
-		if _, err = createLVMVolume(metavolume, config.VgName, config.ThinPool, config.ImageSize, "", snapshots.KindUnknown); err != nil {
+		if _, err = createLVMVolume(ctx, metavolume, config.VgName, config.ThinPool, config.ImageSize, "", snapshots.KindUnknown); err != nil {
 			return nil, errors.Wrap(err, "Unable to create metadata holding volume")
 		}
-		if _, err := toggleactivateLV(config.VgName, metavolume, true); err != nil {
+		if _, err := toggleactivateLV(ctx, config.VgName, metavolume, true); err != nil {
 			log.G(ctx).WithError(err).Warn("Unable to activate metavolume")
 			return nil, errors.Wrap(err, "Unable to create metadata holding volume")
 		}
 
-		if err := formatVolume(config.VgName, metavolume, config.FsType); err != nil {
+		if err := formatVolume(ctx, config.VgName, metavolume, config.FsType); err != nil {
 			log.G(ctx).WithError(err).Warn("Unable to format metavolume")
 			return nil, errors.Wrap(err, "Unable to create metadata holding volume")
 		}
 	} else {
-		if _, err = toggleactivateLV(config.VgName, metavolume, true); err != nil {
+		if _, err = toggleactivateLV(ctx, config.VgName, metavolume, true); err != nil {
 			return nil, errors.Wrap(err, "Unable to activate metavolume")
 		}
 	}
@@ -115,7 +196,7 @@ func NewSnapshotter(ctx context.Context, config *SnapConfig) (snapshots.Snapshot
 		},
 	}
 
-	if err = mount.All(metamount, metavolpath); err != nil {
+	if err = mountAll(ctx, metamount, metavolpath); err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("unable to mount metavolume %+v", metamount))
 	}
 	ms, err := storage.NewMetaStore(filepath.Join(metavolpath, "metadata.db"))
@@ -123,11 +204,31 @@ func NewSnapshotter(ctx context.Context, config *SnapConfig) (snapshots.Snapshot
 		return nil, errors.Wrap(err, "unable to create new meta store")
 	}
 
-	return &snapshotter{
+	o := &snapshotter{
 		config:      config,
 		ms:          ms,
 		metaVolPath: metavolpath,
-	}, nil
+		pools:       pools,
+		policy:      newPlacementPolicy(config.PoolPolicy),
+		keys:        newKeyProvider(config.Encryption, config.RootPath),
+		hooks:       newHooks(config.Hooks),
+		events:      newEventBroker(),
+		locks:       newVolumeLocks(),
+		stopWatch:   func() {},
+	}
+	if err = o.recoverIntents(ctx); err != nil {
+		return nil, errors.Wrap(err, "Unable to recover interrupted operations")
+	}
+	if config.PoolThreshold > 0 {
+		interval, err := time.ParseDuration(config.PoolCheckInterval)
+		if err != nil || interval <= 0 {
+			interval, _ = time.ParseDuration(defaultPoolCheckInterval)
+		}
+		var wctx context.Context
+		wctx, o.stopWatch = context.WithCancel(withPriority(log.WithLogger(context.Background(), log.G(ctx)), priorityBackground))
+		go o.watchPools(wctx, config.PoolThreshold, interval)
+	}
+	return o, nil
 }
 
 // Stat returns the info for an active or committed snapshot by name or
@@ -135,9 +236,12 @@ func NewSnapshotter(ctx context.Context, config *SnapConfig) (snapshots.Snapshot
 //
 // Should be used for parent resolution, existence checks and to discern
 // the kind of snapshot.
-func (o *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+func (o *snapshotter) Stat(ctx context.Context, key string) (_ snapshots.Info, err error) {
+	ctx, span := startSpan(ctx, "lvm.Stat", attribute.String("snapshot.key", key))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
 	log.G(ctx).Debugf("Stat called for: %s", key)
-	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	ctx, t, err := o.transaction(ctx, false)
 	if err != nil {
 		return snapshots.Info{}, err
 	}
@@ -154,14 +258,22 @@ func (o *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, err
 	return info, nil
 }
 
-func (o *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
+func (o *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (_ snapshots.Info, err error) {
+	ctx, span := startSpan(ctx, "lvm.Update", attribute.String("snapshot.key", info.Name))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, info.Name)
 	log.G(ctx).Debugf("Update called for : %+v", info)
-	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	checkpoint, fieldpaths, update := takeCheckpointLabel(&info, fieldpaths)
+	ctx, t, err := o.transaction(ctx, true)
 	if err != nil {
 		return snapshots.Info{}, err
 	}
 
-	info, err = storage.UpdateInfo(ctx, info, fieldpaths...)
+	if update {
+		info, err = storage.UpdateInfo(ctx, info, fieldpaths...)
+	} else {
+		_, info, _, err = storage.GetInfo(ctx, info.Name)
+	}
 	if err != nil {
 		if rerr := t.Rollback(); rerr != nil {
 			log.G(ctx).WithError(rerr).Warn("Failed to rollback transaction")
@@ -173,12 +285,22 @@ func (o *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpath
 		return snapshots.Info{}, err
 	}
 
+	if checkpoint != "" {
+		if err := o.Checkpoint(ctx, checkpoint, info.Name); err != nil {
+			return snapshots.Info{}, err
+		}
+	}
+
 	return info, nil
 }
 
-func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
+func (o *snapshotter) Usage(ctx context.Context, key string) (_ snapshots.Usage, err error) {
+	ctx, span := startSpan(ctx, "lvm.Usage", attribute.String("snapshot.key", key))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	defer observeOperation("usage", time.Now(), &err)
 	log.G(ctx).Debugf("Usage of key %+v", key)
-	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	ctx, t, err := o.transaction(ctx, false)
 	var s storage.Snapshot
 	var du fs.Usage
 	if err != nil {
@@ -189,17 +311,34 @@ func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, e
 			log.G(ctx).WithError(rerr).Warn("Failed to rollback transaction")
 		}
 	}()
-	_, info, usage, err := storage.GetInfo(ctx, key)
+	id, info, usage, err := storage.GetInfo(ctx, key)
 	if err != nil {
 		return snapshots.Usage{}, err
 	}
+	ctx = withSnapshotID(ctx, id)
 
 	if info.Kind == snapshots.KindActive {
 		if s, err = storage.GetSnapshot(ctx, key); err != nil {
 			return snapshots.Usage{}, err
 		}
-		mounts := o.mounts(s)
-		if err = mount.WithTempMount(ctx, mounts, func(root string) error {
+		vol, err := o.volume(t, id)
+		if err != nil {
+			return snapshots.Usage{}, err
+		}
+		if err := checkReady(vol, key); err != nil {
+			return snapshots.Usage{}, err
+		}
+		if vol.Block {
+			// The filesystem may be mounted inside a guest, mounting it on
+			// the host as well could corrupt it.
+			if usage.Size, err = lvUsedSpace(ctx, vol.VgName, id); err != nil {
+				return snapshots.Usage{}, err
+			}
+			log.G(ctx).Debugf("Usage of key %s is %+v", key, usage)
+			return usage, nil
+		}
+		mounts := o.mounts(s, vol)
+		if err = withTempMount(ctx, mounts, func(root string) error {
 			if du, err = fs.DiskUsage(ctx, root); err != nil {
 				return err
 			}
@@ -214,94 +353,198 @@ func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, e
 	return usage, nil
 }
 
-func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	ctx, span := startSpan(ctx, "lvm.Prepare", attribute.String("snapshot.key", key), attribute.String("snapshot.parent", parent))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	defer observeOperation("prepare", time.Now(), &err)
+	// Containers wait on these, they run ahead of everything else
+	ctx = withPriority(ctx, priorityInteractive)
 	log.G(ctx).Debugf("Preparing snapshot for key %s with parent %s", key, parent)
-	return o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
+	return o.createWithHooks(ctx, HookPrepare, snapshots.KindActive, key, parent, opts)
 }
 
-func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
+	ctx, span := startSpan(ctx, "lvm.View", attribute.String("snapshot.key", key), attribute.String("snapshot.parent", parent))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	defer observeOperation("view", time.Now(), &err)
+	// Containers wait on these, they run ahead of everything else
+	ctx = withPriority(ctx, priorityInteractive)
 	log.G(ctx).Debugf("Viewing snapshot for key %s with parent %s", key, parent)
-	return o.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
+	return o.createWithHooks(ctx, HookView, snapshots.KindView, key, parent, opts)
 }
 
 // Mounts returns the mounts for the transaction identified by key. Can be
 // called on an read-write or readonly transaction.
 //
 // This can be used to recover mounts after calling View or Prepare.
-func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+func (o *snapshotter) Mounts(ctx context.Context, key string) (_ []mount.Mount, err error) {
+	ctx, span := startSpan(ctx, "lvm.Mounts", attribute.String("snapshot.key", key))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
 	log.G(ctx).Debugf("Finding mounts for key %s", key)
-	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	ctx, t, err := o.transaction(ctx, false)
 	if err != nil {
 		return nil, err
 	}
-	s, err := storage.GetSnapshot(ctx, key)
-	if err != nil {
-		return []mount.Mount{}, err
-	}
 	defer func() {
 		if rerr := t.Rollback(); rerr != nil {
 			log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
 		}
 	}()
-	log.G(ctx).Debugf("Mounts for key %s is %+v", key, o.mounts(s))
-	return o.mounts(s), nil
+	s, err := storage.GetSnapshot(ctx, key)
+	if err != nil {
+		return []mount.Mount{}, err
+	}
+	ctx = withSnapshotID(ctx, s.ID)
+	vol, err := o.volume(t, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReady(vol, key); err != nil {
+		return nil, err
+	}
+	mounts := o.mounts(s, vol)
+	log.G(ctx).Debugf("Mounts for key %s is %+v", key, mounts)
+	return mounts, nil
 }
 
-func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
-	log.G(ctx).Debugf("Commit snapshot for key %s", key)
-	ctx, t, err := o.ms.TransactionContext(ctx, true)
-	var du fs.Usage
-	var usage snapshots.Usage
-	if err != nil {
+func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) (err error) {
+	ctx, span := startSpan(ctx, "lvm.Commit", attribute.String("snapshot.key", key), attribute.String("snapshot.name", name))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	defer observeOperation("commit", time.Now(), &err)
+
+	if o.hooks.has(hookPre, HookCommit) {
+		ev, err := o.hookEvent(ctx, HookCommit, key)
+		if err != nil {
+			return err
+		}
+		// The committed snapshot only carries the labels given to Commit
+		if ev.Labels, err = optLabels(opts); err != nil {
+			return err
+		}
+		ev.Name = name
+		if err := o.hooks.run(ctx, hookPre, ev); err != nil {
+			return err
+		}
+	}
+	if err = o.commit(ctx, name, key, opts); err != nil {
 		return err
 	}
+	o.notify(ctx, Event{Type: EventCommitted}, name)
+	if o.hooks.has(hookPost, HookCommit) {
+		ev, err := o.hookEvent(ctx, HookCommit, name)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("Unable to describe the committed snapshot to the post commit hooks")
+			return nil
+		}
+		ev.Key, ev.Name = key, name
+		o.hooks.run(ctx, hookPost, ev)
+	}
+	return nil
+}
 
-	id, _, _, err := storage.GetInfo(ctx, key)
+// commit runs the device work on the volume of the active snapshot outside
+// of metadata transactions, the snapshot is locked meanwhile. The commit is
+// published in a short transaction at the end.
+func (o *snapshotter) commit(ctx context.Context, name, key string, opts []snapshots.Opt) (err error) {
+	log.G(ctx).Debugf("Commit snapshot for key %s", key)
+	id, unlock, err := o.lockSnapshot(ctx, key)
 	if err != nil {
 		return err
 	}
+	defer unlock()
+	ctx = withSnapshotID(ctx, id)
 
-	s, err := storage.GetSnapshot(ctx, key)
-	mounts := o.mounts(s)
-	if err = mount.WithTempMount(ctx, mounts, func(root string) error {
-		if du, err = fs.DiskUsage(ctx, root); err != nil {
+	var (
+		s   storage.Snapshot
+		vol volume
+	)
+	if err = o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		var err error
+		if s, err = storage.GetSnapshot(ctx, key); err != nil {
 			return err
 		}
-		usage = snapshots.Usage(du)
-		return nil
+		vol, err = o.volume(t, id)
+		return err
 	}); err != nil {
 		return err
 	}
+	if err = checkReady(vol, key); err != nil {
+		return err
+	}
+	if err = o.recordIntent(ctx, id, intent{Op: intentCommit, Key: key, Name: name, Volume: vol}); err != nil {
+		return err
+	}
+	// The snapshot stays active when the commit fails. What could not be
+	// undone is left to the recovery of the intent.
+	var undo undoStack
 	defer func() {
-		if err != nil && t != nil {
-			if rerr := t.Rollback(); rerr != nil {
-				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
-			}
+		if err != nil && undo.run(ctx) {
+			o.clearIntent(ctx, id)
 		}
 	}()
 
-	if _, err = storage.CommitActive(ctx, key, name, usage, opts...); err != nil {
-		return errors.Wrap(err, "failed to commit snapshot")
+	// Mounts of the caller still around are either refused, lazily
+	// detached or left on a volume of their own, depending on the policy.
+	mounted, err := o.releaseDevice(ctx, key, o.getSnapshotDir(vol, id), true)
+	if err != nil {
+		return err
+	}
+	if len(mounted) > 0 {
+		if err = o.detachVolume(ctx, key, vol, id, &undo); err != nil {
+			return err
+		}
+	}
+
+	var usage snapshots.Usage
+	mounts := o.mounts(s, vol)
+	if err = withTempMount(ctx, mounts, func(root string) error {
+		if o.config.Discard.TrimOnCommit {
+			if terr := o.trimVolume(ctx, root, vol, id); terr != nil {
+				log.G(ctx).WithError(terr).Warnf("Unable to trim volume %s", id)
+			}
+		}
+		du, err := fs.DiskUsage(ctx, root)
+		if err != nil {
+			return err
+		}
+		usage = snapshots.Usage(du)
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	if err = unmountVolume(o.config.VgName, id); err != nil {
-		return errors.Wrap(err, "Unable to remove all the volume mounts")
+	if o.config.Verity {
+		if vol.VerityHash, err = o.protectVolume(ctx, vol, id, &undo); err != nil {
+			return errors.Wrap(err, "Unable to protect volume with dm-verity")
+		}
+		opts = append(opts[:len(opts):len(opts)], withLabel(LabelVerityRootHash, vol.VerityHash))
 	}
 
 	// Deactivate the volume in LVM to free up /dev/dm-XX names on the host
-	if _, err = toggleactivateLV(o.config.VgName, id, false); err != nil {
+	if err = o.deactivateVolume(ctx, vol, id); err != nil {
 		return errors.Wrap(err, "Failed to change permissions on volume")
 	}
+	active := vol
+	active.VerityHash = ""
+	undo.push("reactivate volume", func(ctx context.Context) error {
+		return o.activateVolume(ctx, active, id)
+	})
 
-	err = t.Commit()
-	if err != nil {
-		log.G(ctx).WithError(err).Warn("Transaction commit failed")
-		if derr := unmountVolume(o.config.VgName, id); derr != nil {
-			return errors.Wrap(err, "Unable to remove all the volume mounts")
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if o.config.Verity {
+			if err := putVolume(t, id, vol); err != nil {
+				return errors.Wrap(err, "Unable to record volume")
+			}
 		}
-		if _, derr := removeLVMVolume(o.config.VgName, id); derr != nil {
-			log.G(ctx).WithError(derr).Warn("Unable to delete volume")
+		if _, err := storage.CommitActive(ctx, key, name, usage, opts...); err != nil {
+			return errors.Wrap(err, "failed to commit snapshot")
 		}
+		return deleteIntent(t, id)
+	}); err != nil {
 		return err
 	}
 	return nil
@@ -310,49 +553,168 @@ func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snap
 // Remove abandons the transaction identified by key. All resources
 // associated with the key will be removed.
 func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
+	ctx, span := startSpan(ctx, "lvm.Remove", attribute.String("snapshot.key", key))
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, key)
+	defer observeOperation("remove", time.Now(), &err)
+
+	// The snapshot is described before it is gone, to the post hooks and
+	// the subscribers as well
+	var (
+		r         snapshotRecord
+		described bool
+	)
+	if o.hooks.has(hookPre, HookRemove) || o.hooks.has(hookPost, HookRemove) || o.events.active() {
+		if r, err = o.describe(ctx, key); err != nil {
+			return err
+		}
+		described = true
+	}
+	ev := o.recordHookEvent(HookRemove, key, r)
+	if err = o.hooks.run(ctx, hookPre, ev); err != nil {
+		return err
+	}
+	if err = o.remove(ctx, key); err != nil {
+		return err
+	}
+	o.hooks.run(ctx, hookPost, ev)
+	if described {
+		o.publishSnapshotEvent(ctx, Event{Type: EventRemoved}, r)
+	}
+	return nil
+}
+
+// remove drops the snapshot in a short transaction which marks its volume
+// as being removed, tears the volume down outside of it and deletes the
+// record in another one. The snapshot can not be brought back once it is
+// gone from the metadata, a removal failing after that is completed from the
+// intent log on the next start.
+func (o *snapshotter) remove(ctx context.Context, key string) (err error) {
 	log.G(ctx).Debugf("Remove contents of key %s", key)
-	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	id, unlock, err := o.lockSnapshot(ctx, key)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err != nil && t != nil {
-			if rerr := t.Rollback(); rerr != nil {
-				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+	defer unlock()
+	ctx = withSnapshotID(ctx, id)
+
+	var vol volume
+	if err = o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		var err error
+		vol, err = o.volume(t, id)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if _, err = o.releaseDevice(ctx, key, o.getSnapshotDir(vol, id), false); err != nil {
+		return errors.Wrap(err, "Unable to release volume")
+	}
+
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if _, _, err := storage.Remove(ctx, key); err != nil {
+			return errors.Wrap(err, "failed to remove")
+		}
+		if err := putIntent(t, id, intent{Op: intentRemove, Key: key, Volume: vol}); err != nil {
+			return errors.Wrap(err, "Unable to record remove intent")
+		}
+		removing := vol
+		removing.State = volumeRemoving
+		return putVolume(t, id, removing)
+	}); err != nil {
+		return err
+	}
+
+	if vol.VerityOf != "" {
+		// Verity views have no volume of their own
+		if err = o.closeView(ctx, vol, id); err != nil {
+			return errors.Wrap(err, "Unable to close verity view")
+		}
+	} else {
+		if o.config.WipePolicy != "" {
+			// Removal fails rather than leaving data of the volume behind
+			if err = o.wipeVolume(ctx, key, vol, id); err != nil {
+				return errors.Wrap(err, "Unable to wipe volume")
+			}
+		} else if o.config.Discard.OnRemove {
+			if derr := o.discardVolume(ctx, vol, id); derr != nil {
+				log.G(ctx).WithError(derr).Warnf("Unable to discard volume %s", id)
 			}
 		}
-	}()
 
-	id, _, err := storage.Remove(ctx, key)
-	if err != nil {
-		return errors.Wrap(err, "failed to remove")
-	}
+		if err = o.deactivateVolume(ctx, vol, id); err != nil {
+			return errors.Wrap(err, "Unable to deactivate metavolume")
+		}
 
-	if err = unmountVolume(o.config.VgName, id); err != nil {
-		return errors.Wrap(err, "Unable to remove all the volume mounts")
+		if err = o.removeVolume(ctx, vol, id); err != nil {
+			return errors.Wrap(err, "failed to delete LVM volume")
+		}
 	}
 
-	if _, err = toggleactivateLV(o.config.VgName, id, false); err != nil {
-		return errors.Wrap(err, "Unable to deactivate metavolume")
+	var dropKey bool
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if err := deleteVolume(t, id); err != nil {
+			return errors.Wrap(err, "failed to delete volume record")
+		}
+		if err := deleteIntent(t, id); err != nil {
+			return err
+		}
+		if !vol.Encrypted {
+			return nil
+		}
+		// The key is shared by all the snapshots of the encrypted base
+		// volume, drop it once the last of them is gone.
+		inUse, err := keyInUse(t, vol.KeyID)
+		if err != nil {
+			return errors.Wrap(err, "failed to check key usage")
+		}
+		dropKey = !inUse
+		return nil
+	}); err != nil {
+		return err
 	}
+	if dropKey {
+		if kerr := o.keys.delete(vol.KeyID); kerr != nil {
+			log.G(ctx).WithError(kerr).Warnf("Unable to delete key %s", vol.KeyID)
+		}
+	}
+	return nil
+}
 
-	_, err = removeLVMVolume(o.config.VgName, id)
+// closeView closes the verity device of a removed view, the parent is locked
+// as it is deactivated along with its last view
+func (o *snapshotter) closeView(ctx context.Context, vol volume, id string) error {
+	unlock, err := o.locks.lock(ctx, vol.VerityOf)
 	if err != nil {
-		return errors.Wrap(err, "failed to delete LVM volume")
+		return err
 	}
+	defer unlock()
 
-	err = t.Commit()
-	if err != nil {
-		return errors.Wrap(err, "failed to commit")
+	var (
+		views     int
+		parentVol volume
+	)
+	if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		var err error
+		if views, err = verityViews(t, vol.VerityOf); err != nil {
+			return err
+		}
+		parentVol, err = o.volume(t, vol.VerityOf)
+		return err
+	}); err != nil {
+		return err
 	}
-	t = nil
-	return nil
+	// The record of the view is still around
+	return o.closeVerityView(ctx, vol, id, parentVol, views <= 1)
 }
 
 // Walk the committed snapshots.
-func (o *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
+func (o *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...string) (err error) {
+	ctx, span := startSpan(ctx, "lvm.Walk")
+	defer endSpan(span, &err)
+	ctx = withSnapshotKey(ctx, "")
 	log.G(ctx).Debugf("Walk through %+v", ctx)
-	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	ctx, t, err := o.transaction(ctx, false)
 	if err != nil {
 		return err
 	}
@@ -364,76 +726,600 @@ func (o *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...str
 	return storage.WalkInfo(ctx, fn, fs...)
 }
 
+// createWithHooks creates the snapshot between the hooks of the operation
+func (o *snapshotter) createWithHooks(ctx context.Context, operation string, kind snapshots.Kind, key, parent string, opts []snapshots.Opt) ([]mount.Mount, error) {
+	if o.hooks.has(hookPre, operation) {
+		ev, err := newSnapshotHookEvent(operation, kind, key, parent, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.hooks.run(ctx, hookPre, ev); err != nil {
+			return nil, err
+		}
+	}
+	mounts, err := o.createSnapshot(ctx, kind, key, parent, opts)
+	if err != nil {
+		return nil, err
+	}
+	o.notify(ctx, Event{Type: EventCreated}, key)
+	if o.hooks.has(hookPost, operation) {
+		ev, err := o.hookEvent(ctx, operation, key)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("Unable to describe the snapshot to the post %s hooks", operation)
+			return mounts, nil
+		}
+		o.hooks.run(ctx, hookPost, ev)
+	}
+	return mounts, nil
+}
+
+// volumePlan is how the volume of a reserved snapshot gets built
+type volumePlan struct {
+	vol       volume
+	parent    string
+	parentVol volume
+	pid       string
+	// clone copies the parent from another pool into a new base volume
+	clone bool
+	// view serves the snapshot from the verity device of its parent
+	view bool
+}
+
+// createSnapshot reserves the snapshot and its volume record in a short
+// transaction, builds the volume outside of it and publishes the record in
+// another one. Snapshot operations thus never wait on the LVM and mkfs
+// commands of each other while holding the metadata store, and the record
+// marks the volume as being created in between.
 func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts []snapshots.Opt) (_ []mount.Mount, err error) {
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
 
-	pvol := ""
-	ctx, t, err := o.ms.TransactionContext(ctx, true)
-	if err != nil {
+	// The placement policy may query the pools, which is done before the
+	// snapshot is reserved
+	var placed volume
+	if parent == "" {
+		if placed, err = o.placeVolume(ctx, base.Labels); err != nil {
+			return nil, errors.Wrap(err, "Unable to place volume")
+		}
+	}
+
+	var (
+		s      storage.Snapshot
+		plan   volumePlan
+		unlock func()
+	)
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		var err error
+		if s, err = storage.CreateSnapshot(ctx, kind, key, parent, opts...); err != nil {
+			return errors.Wrap(err, "failed to create snapshot")
+		}
+		if plan, err = o.planVolume(ctx, t, kind, s, parent, placed, base.Labels); err != nil {
+			return err
+		}
+		pending := plan.vol
+		pending.State = volumeCreating
+		if err := putVolume(t, s.ID, pending); err != nil {
+			return errors.Wrap(err, "Unable to record volume")
+		}
+		if err := putIntent(t, s.ID, intent{Op: intentCreate, Key: key, Volume: plan.vol}); err != nil {
+			return errors.Wrap(err, "Unable to record create intent")
+		}
+		// Nobody knows the new ID before the transaction is committed
+		unlock, err = o.locks.reserve(s.ID)
+		return err
+	}); err != nil {
+		if unlock != nil {
+			unlock()
+		}
 		return nil, err
 	}
+	defer unlock()
+	ctx = withSnapshotID(ctx, s.ID)
+	var undo undoStack
 	defer func() {
-		if err != nil && t != nil {
-			if rerr := t.Rollback(); rerr != nil {
-				log.G(ctx).WithError(rerr).Warn("Failed to rollback transaction")
-			}
+		if err != nil {
+			o.abandonSnapshot(ctx, key, s.ID, undo.run(ctx))
 		}
 	}()
 
-	s, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+	vol, err := o.buildVolume(ctx, kind, s, plan, &undo)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create snapshot")
+		return nil, err
 	}
+	if err = o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if err := putVolume(t, s.ID, vol); err != nil {
+			return err
+		}
+		return deleteIntent(t, s.ID)
+	}); err != nil {
+		return nil, errors.Wrap(err, "Unable to record volume")
+	}
+
+	mounts := o.mounts(s, vol)
+	log.G(ctx).Debugf("Mounts for snapshot %s is %+v", s.ID, mounts)
+	o.removeLostFound(ctx, mounts)
+	return mounts, nil
+}
 
+// planVolume decides where the volume of the reserved snapshot goes. Base
+// volumes were placed already.
+func (o *snapshotter) planVolume(ctx context.Context, t storage.Transactor, kind snapshots.Kind, s storage.Snapshot, parent string, placed volume, labels map[string]string) (volumePlan, error) {
+	var err error
+	plan := volumePlan{parent: parent}
 	if len(s.ParentIDs) == 0 {
-		// Create a new logical volume without a base snapshot
-		pvol = ""
+		plan.vol = placed
 	} else {
-		// Create a snapshot from the parent
-		pvol = s.ParentIDs[0]
+		// Create a snapshot from the parent, which stays in the pool of the
+		// parent unless the namespace is pinned to another pool.
+		plan.pid = s.ParentIDs[0]
+		if plan.parentVol, err = o.volume(t, plan.pid); err != nil {
+			return volumePlan{}, err
+		}
+		plan.vol = plan.parentVol
+		plan.vol.VerityHash = ""
+		ns, _ := namespaces.Namespace(ctx)
+		if target, ok := o.config.NamespacePool(ns); ok && target != plan.parentVol.Pool {
+			if o.config.CrossPoolParent == CrossPoolReject {
+				return volumePlan{}, errors.Wrapf(errdefs.ErrFailedPrecondition, "parent %q is in pool %s, namespace %q uses pool %s", parent, plan.parentVol.Pool, ns, target)
+			}
+			if plan.vol, err = o.poolVolume(target); err != nil {
+				return volumePlan{}, err
+			}
+			plan.clone = true
+		}
+	}
+
+	// Views of protected layers are served straight from the verity
+	// device of the parent.
+	if plan.parentVol.VerityHash != "" && kind == snapshots.KindView && !plan.clone {
+		plan.view = true
+		plan.vol = volume{
+			Pool:     plan.parentVol.Pool,
+			VgName:   plan.parentVol.VgName,
+			ThinPool: plan.parentVol.ThinPool,
+			VerityOf: plan.pid,
+		}
+		return plan, nil
+	}
+
+	if plan.vol.Block, err = blockModeRequested(o.config.MountMode, labels); err != nil {
+		return volumePlan{}, err
+	}
+	if plan.pid == "" || plan.clone {
+		if plan.vol.Encrypted, err = encryptionRequested(o.config.Encryption, labels); err != nil {
+			return volumePlan{}, err
+		}
+		if plan.vol.Encrypted {
+			plan.vol.KeyID = s.ID
+		}
 	}
-	if _, err := createLVMVolume(s.ID, o.config.VgName, o.config.ThinPool, o.config.ImageSize, pvol, kind); err != nil {
+	return plan, nil
+}
+
+// buildVolume runs the device work of the plan and returns the volume record
+// to publish. The steps taken are undone through undo.
+func (o *snapshotter) buildVolume(ctx context.Context, kind snapshots.Kind, s storage.Snapshot, plan volumePlan, undo *undoStack) (volume, error) {
+	vol := plan.vol
+	if plan.parentVol.VerityHash != "" || plan.clone {
+		// The parent gets activated, which has to wait for the other
+		// snapshots built from it
+		unlock, err := o.locks.lock(ctx, plan.pid)
+		if err != nil {
+			return volume{}, err
+		}
+		defer unlock()
+	}
+
+	if plan.view {
+		view, err := o.openVerityView(ctx, plan.parentVol, plan.pid, s.ID)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("Unable to open verity view")
+			return volume{}, errors.Wrap(err, "Unable to create view")
+		}
+		undo.push("close verity view", func(ctx context.Context) error {
+			_, err := verityClose(ctx, verityName(view.VgName, s.ID))
+			return err
+		})
+		return view, nil
+	}
+	if plan.parentVol.VerityHash != "" {
+		views, err := o.countVerityViews(ctx, plan.pid)
+		if err != nil {
+			return volume{}, err
+		}
+		if err := o.verifyVolume(ctx, views, plan.parentVol, plan.pid); err != nil {
+			log.G(ctx).WithError(err).Warn("Parent volume failed verification")
+			return volume{}, errors.Wrapf(errdefs.ErrFailedPrecondition, "parent %q is corrupted: %v", plan.parent, err)
+		}
+	}
+
+	lvparent := plan.pid
+	if plan.clone {
+		// Thin snapshots can not cross pools, the parent is copied into a
+		// new base volume instead.
+		lvparent = ""
+	}
+	if _, err := createLVMVolume(ctx, s.ID, vol.VgName, vol.ThinPool, o.config.ImageSize, lvparent, kind); err != nil {
 		log.G(ctx).WithError(err).Warn("Unable to create volume")
-		return nil, errors.Wrap(err, "Unable to create volume")
+		return volume{}, errors.Wrap(err, "Unable to create volume")
 	}
+	undo.push("delete volume", func(ctx context.Context) error {
+		_, err := removeLVMVolume(ctx, vol.VgName, s.ID)
+		return err
+	})
 
-	if _, err := toggleactivateLV(o.config.VgName, s.ID, true); err != nil {
+	if _, err := toggleactivateLV(ctx, vol.VgName, s.ID, true); err != nil {
 		log.G(ctx).WithError(err).Warn("Unable to activate new volume")
-		return nil, errors.Wrap(err, "Unable to create volume")
+		return volume{}, errors.Wrap(err, "Unable to create volume")
+	}
+	undo.push("deactivate volume", func(ctx context.Context) error {
+		_, err := toggleactivateLV(ctx, vol.VgName, s.ID, false)
+		return err
+	})
+
+	if lvparent == "" && vol.Encrypted {
+		// The key is created before the volume is formatted with it
+		undo.push("delete key", func(ctx context.Context) error {
+			return o.keys.delete(vol.KeyID)
+		})
+		if err := o.encryptVolume(ctx, vol, s.ID); err != nil {
+			log.G(ctx).WithError(err).Warn("Unable to encrypt new volume")
+			return volume{}, errors.Wrap(err, "Unable to create volume")
+		}
+	}
+
+	if err := o.openVolume(ctx, vol, s.ID); err != nil {
+		log.G(ctx).WithError(err).Warn("Unable to open new volume")
+		return volume{}, errors.Wrap(err, "Unable to create volume")
+	}
+	if vol.Encrypted {
+		undo.push("close encrypted volume", func(ctx context.Context) error {
+			_, err := closeCrypt(ctx, vol.VgName, s.ID)
+			return err
+		})
 	}
 
-	if pvol == "" {
-		if err := formatVolume(o.config.VgName, s.ID, o.config.FsType); err != nil {
+	if lvparent == "" {
+		if err := formatDevice(ctx, o.getSnapshotDir(vol, s.ID), o.config.FsType); err != nil {
 			log.G(ctx).WithError(err).Warn("Unable to format new volume")
-			return nil, errors.Wrap(err, "Unable to create volume")
+			return volume{}, errors.Wrap(err, "Unable to create volume")
 		}
 	}
 
-	err = t.Commit()
-	if err != nil {
-		return nil, err
+	if plan.clone {
+		if err := o.cloneVolume(ctx, plan.parentVol, plan.pid, vol, s.ID); err != nil {
+			log.G(ctx).WithError(err).Warn("Unable to clone parent volume")
+			return volume{}, errors.Wrap(err, "Unable to create volume")
+		}
 	}
-	t = nil
+	return vol, nil
+}
 
-	log.G(ctx).Debugf("Mounts for key %s is %+v", key, o.mounts(s))
-	mounts := o.mounts(s)
+// abandonSnapshot drops the reservation of a snapshot whose volume could not
+// be built, once what was built of it is undone. When it was not entirely
+// undone, the volume record and the intent are kept for the recovery to
+// delete what is left.
+func (o *snapshotter) abandonSnapshot(ctx context.Context, key, id string, undone bool) {
+	if err := o.withTransaction(ctx, true, func(ctx context.Context, t storage.Transactor) error {
+		if _, _, err := storage.Remove(ctx, key); err != nil {
+			return err
+		}
+		if !undone {
+			log.G(ctx).Warnf("Leaving the volume of snapshot %s to recovery", key)
+			return nil
+		}
+		if err := deleteVolume(t, id); err != nil {
+			return err
+		}
+		return deleteIntent(t, id)
+	}); err != nil {
+		log.G(ctx).WithError(err).Warnf("Unable to drop the reservation of snapshot %s", key)
+	}
+}
 
-	// Ext4 creates a "lost+found" directory which messes up with difflayer.
-	// Clear it out prior to handing this over.
+// removeLostFound removes the "lost+found" directory ext4 creates, which
+// messes up with difflayer. Clear it out prior to handing the mounts over.
+func (o *snapshotter) removeLostFound(ctx context.Context, mounts []mount.Mount) {
 	if o.config.FsType == "ext4" {
-		_ = mount.WithTempMount(ctx, mounts, func(root string) error {
+		_ = withTempMount(ctx, mounts, func(root string) error {
 			return os.Remove(filepath.Join(root, "lost+found"))
 		})
 	}
+}
 
-	return mounts, nil
+// volume returns the record of the volume backing the snapshot with the given
+// ID. Volumes created before records were kept live in the primary pool.
+func (o *snapshotter) volume(t storage.Transactor, id string) (volume, error) {
+	vol, ok, err := getVolume(t, id)
+	if err != nil {
+		return volume{}, err
+	}
+	if !ok {
+		primary := o.pools[0]
+		vol = volume{
+			Pool:     primary.Name,
+			VgName:   primary.VgName,
+			ThinPool: primary.ThinPool,
+		}
+	}
+	return vol, nil
+}
 
+// poolVolume returns a volume record for the pool with the given name
+func (o *snapshotter) poolVolume(name string) (volume, error) {
+	for _, p := range o.pools {
+		if p.Name == name {
+			return volume{
+				Pool:     p.Name,
+				VgName:   p.VgName,
+				ThinPool: p.ThinPool,
+			}, nil
+		}
+	}
+	return volume{}, errors.Wrapf(errdefs.ErrNotFound, "pool %q", name)
 }
 
-func (o *snapshotter) getSnapshotDir(id string) string {
-	return filepath.Join("/dev", o.config.VgName, id)
+// placeVolume picks the pool for a new base volume. Namespaces pinned to a
+// pool always use that pool, otherwise the configured policy decides among
+// the pools of the tier requested through the labels.
+func (o *snapshotter) placeVolume(ctx context.Context, labels map[string]string) (volume, error) {
+	ns, _ := namespaces.Namespace(ctx)
+	if name, ok := o.config.NamespacePool(ns); ok {
+		log.G(ctx).Debugf("Placing new volume of namespace %q in pool %s", ns, name)
+		return o.poolVolume(name)
+	}
+
+	candidates, err := candidatePools(o.pools, labels[LabelTier])
+	if err != nil {
+		return volume{}, err
+	}
+	p := candidates[0]
+	if len(candidates) > 1 {
+		if p, err = o.policy.pick(ctx, candidates); err != nil {
+			return volume{}, err
+		}
+	}
+	log.G(ctx).Debugf("Placing new volume in pool %s", p.Name)
+	return volume{
+		Pool:     p.Name,
+		VgName:   p.VgName,
+		ThinPool: p.ThinPool,
+	}, nil
 }
 
-func (o *snapshotter) mounts(s storage.Snapshot) []mount.Mount {
+// cloneVolume copies the contents of the committed parent volume into the
+// freshly formatted volume with the given ID.
+func (o *snapshotter) cloneVolume(ctx context.Context, parentVol volume, pid string, vol volume, id string) (err error) {
+	if err = o.activateVolume(ctx, parentVol, pid); err != nil {
+		return errors.Wrap(err, "Unable to activate parent volume")
+	}
+	defer func() {
+		if derr := o.deactivateVolume(ctx, parentVol, pid); derr != nil {
+			log.G(ctx).WithError(derr).Warn("Unable to deactivate parent volume")
+		}
+	}()
+
+	src := o.mounts(storage.Snapshot{ID: pid, Kind: snapshots.KindView}, parentVol)
+	dst := o.mounts(storage.Snapshot{ID: id, Kind: snapshots.KindActive}, vol)
+	return withTempMount(ctx, src, func(srcRoot string) error {
+		return withTempMount(ctx, dst, func(dstRoot string) error {
+			return fs.CopyDir(dstRoot, srcRoot)
+		})
+	})
+}
+
+// encryptVolume sets up LUKS on the freshly created volume with a new key
+func (o *snapshotter) encryptVolume(ctx context.Context, vol volume, id string) error {
+	key, err := o.keys.create(vol.KeyID)
+	if err != nil {
+		return err
+	}
+	if out, err := luksFormat(ctx, vol.VgName, id, key); err != nil {
+		return errors.Wrapf(err, "luksFormat failed: %s", out)
+	}
+	return nil
+}
+
+// openVolume makes the filesystem device of an active volume available
+func (o *snapshotter) openVolume(ctx context.Context, vol volume, id string) error {
+	if !vol.Encrypted {
+		return nil
+	}
+	key, err := o.keys.get(vol.KeyID)
+	if err != nil {
+		return err
+	}
+	// Discards from the filesystem only reach the pool through the crypt
+	// mapping when it lets them pass
+	discards := o.config.Discard.Mount || o.config.Discard.TrimOnCommit
+	if out, err := openCrypt(ctx, vol.VgName, id, key, discards); err != nil {
+		return errors.Wrapf(err, "Unable to open encrypted volume: %s", out)
+	}
+	return nil
+}
+
+// activateVolume activates the logical volume and opens it
+func (o *snapshotter) activateVolume(ctx context.Context, vol volume, id string) error {
+	if _, err := toggleactivateLV(ctx, vol.VgName, id, true); err != nil {
+		return err
+	}
+	return o.openVolume(ctx, vol, id)
+}
+
+// deactivateVolume tears down the mappings stacked on the logical volume
+// before deactivating it
+func (o *snapshotter) deactivateVolume(ctx context.Context, vol volume, id string) error {
+	o.verified.Delete(id)
+	if vol.Encrypted {
+		if out, err := closeCrypt(ctx, vol.VgName, id); err != nil {
+			return errors.Wrapf(err, "Unable to close encrypted volume: %s", out)
+		}
+	}
+	if vol.VerityHash != "" {
+		if _, err := toggleactivateLV(ctx, vol.VgName, hashLVName(id), false); err != nil {
+			return err
+		}
+	}
+	_, err := toggleactivateLV(ctx, vol.VgName, id, false)
+	return err
+}
+
+// removeVolume deletes the logical volume along with its hash volume
+func (o *snapshotter) removeVolume(ctx context.Context, vol volume, id string) error {
+	if vol.VerityHash != "" {
+		if out, err := removeLVMVolume(ctx, vol.VgName, hashLVName(id)); err != nil {
+			return errors.Wrapf(err, "Unable to delete hash volume: %s", out)
+		}
+	}
+	if out, err := removeLVMVolume(ctx, vol.VgName, id); err != nil {
+		return errors.Wrapf(err, "Unable to delete volume: %s", out)
+	}
+	return nil
+}
+
+// protectVolume builds the dm-verity hash tree of an unmounted volume into a
+// companion volume and returns the root hash. The companion volume is
+// deleted through undo.
+func (o *snapshotter) protectVolume(ctx context.Context, vol volume, id string, undo *undoStack) (string, error) {
+	size, err := lvSize(ctx, vol.VgName, id)
+	if err != nil {
+		return "", err
+	}
+	hashlv := hashLVName(id)
+	if out, err := createLVMVolume(ctx, hashlv, vol.VgName, vol.ThinPool, verityHashSize(size), "", snapshots.KindUnknown); err != nil {
+		return "", errors.Wrapf(err, "Unable to create hash volume: %s", out)
+	}
+	undo.push("delete hash volume", func(ctx context.Context) error {
+		_, err := removeLVMVolume(ctx, vol.VgName, hashlv)
+		return err
+	})
+	if _, err := toggleactivateLV(ctx, vol.VgName, hashlv, true); err != nil {
+		return "", errors.Wrap(err, "Unable to activate hash volume")
+	}
+	undo.push("deactivate hash volume", func(ctx context.Context) error {
+		_, err := toggleactivateLV(ctx, vol.VgName, hashlv, false)
+		return err
+	})
+	return verityFormat(ctx, o.getSnapshotDir(vol, id), filepath.Join("/dev", vol.VgName, hashlv))
+}
+
+// verifyVolume checks a protected volume against its hash tree before it is
+// used as a parent. Reading the whole volume is only done once per
+// activation: a verified volume stays active, and is verified again once
+// it was deactivated. A volume failing verification stays active when views
+// of it exist.
+func (o *snapshotter) verifyVolume(ctx context.Context, views int, vol volume, id string) (err error) {
+	if _, ok := o.verified.Load(id); ok {
+		return nil
+	}
+	if err = o.activateVolume(ctx, vol, id); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil || views > 0 {
+			return
+		}
+		if derr := o.deactivateVolume(ctx, vol, id); derr != nil {
+			log.G(ctx).WithError(derr).Warn("Unable to deactivate volume")
+		}
+	}()
+	if _, err = toggleactivateLV(ctx, vol.VgName, hashLVName(id), true); err != nil {
+		return err
+	}
+	if err = verityVerify(ctx, o.getSnapshotDir(vol, id), filepath.Join("/dev", vol.VgName, hashLVName(id)), vol.VerityHash); err != nil {
+		return err
+	}
+	o.verified.Store(id, struct{}{})
+	return nil
+}
+
+// countVerityViews counts the views of the volume with the given ID in a
+// transaction of its own
+func (o *snapshotter) countVerityViews(ctx context.Context, id string) (views int, err error) {
+	err = o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) error {
+		views, err = verityViews(t, id)
+		return err
+	})
+	return views, err
+}
+
+// openVerityView opens a verity device on top of the protected parent volume
+// for the view with the given ID. The parent stays active as long as views
+// of it exist.
+func (o *snapshotter) openVerityView(ctx context.Context, parentVol volume, pid string, id string) (volume, error) {
+	if err := o.activateVolume(ctx, parentVol, pid); err != nil {
+		return volume{}, err
+	}
+	if _, err := toggleactivateLV(ctx, parentVol.VgName, hashLVName(pid), true); err != nil {
+		return volume{}, err
+	}
+	data := o.getSnapshotDir(parentVol, pid)
+	hash := filepath.Join("/dev", parentVol.VgName, hashLVName(pid))
+	if out, err := verityOpen(ctx, data, verityName(parentVol.VgName, id), hash, parentVol.VerityHash); err != nil {
+		return volume{}, errors.Wrapf(err, "veritysetup open failed: %s", out)
+	}
+	return volume{
+		Pool:     parentVol.Pool,
+		VgName:   parentVol.VgName,
+		ThinPool: parentVol.ThinPool,
+		VerityOf: pid,
+	}, nil
+}
+
+// closeVerityView closes the verity device of a view and deactivates the
+// parent when it was its last view
+func (o *snapshotter) closeVerityView(ctx context.Context, vol volume, id string, parentVol volume, last bool) error {
+	if out, err := verityClose(ctx, verityName(vol.VgName, id)); err != nil {
+		return errors.Wrapf(err, "veritysetup close failed: %s", out)
+	}
+	if !last {
+		return nil
+	}
+	return o.deactivateVolume(ctx, parentVol, vol.VerityOf)
+}
+
+// getSnapshotDir returns the device holding the filesystem of the volume
+func (o *snapshotter) getSnapshotDir(vol volume, id string) string {
+	if vol.VerityOf != "" {
+		return verityDevice(vol.VgName, id)
+	}
+	if vol.Encrypted {
+		return cryptDevice(vol.VgName, id)
+	}
+	return filepath.Join("/dev", vol.VgName, id)
+}
+
+// blockModeRequested tells whether a new snapshot is handed out as a raw
+// block device
+func blockModeRequested(mode string, labels map[string]string) (bool, error) {
+	if v, ok := labels[LabelMountMode]; ok {
+		mode = v
+	}
+	switch mode {
+	case "", MountModeFilesystem:
+		return false, nil
+	case MountModeBlock:
+		return true, nil
+	default:
+		return false, errors.Wrapf(errdefs.ErrInvalidArgument, "invalid value %q for label %s", mode, LabelMountMode)
+	}
+}
+
+func withLabel(key, value string) snapshots.Opt {
+	return func(info *snapshots.Info) error {
+		if info.Labels == nil {
+			info.Labels = map[string]string{}
+		}
+		info.Labels[key] = value
+		return nil
+	}
+}
+
+func (o *snapshotter) mounts(s storage.Snapshot, vol volume) []mount.Mount {
 	var (
 		source   string
 		moptions []string
@@ -441,6 +1327,9 @@ func (o *snapshotter) mounts(s storage.Snapshot) []mount.Mount {
 
 	if s.Kind == snapshots.KindView {
 		moptions = append(moptions, "ro")
+	} else if o.config.Discard.Mount {
+		// Return blocks freed by the container to the pool right away
+		moptions = append(moptions, "discard")
 	}
 
 	//This will allow two filesystems with same UUID to be mounted on a machine.
@@ -448,7 +1337,11 @@ func (o *snapshotter) mounts(s storage.Snapshot) []mount.Mount {
 		moptions = append(moptions, "nouuid")
 	}
 
-	source = o.getSnapshotDir(s.ID)
+	// Block volumes are described the same way the devmapper snapshotter
+	// does: the device as source and the filesystem as type, so VM based
+	// runtimes can pass the device into the guest while runtimes using host
+	// mounts can still mount it.
+	source = o.getSnapshotDir(vol, s.ID)
 	return []mount.Mount{
 		{
 			Source:  source,
@@ -459,16 +1352,20 @@ func (o *snapshotter) mounts(s storage.Snapshot) []mount.Mount {
 }
 
 // Close closes the snapshotter
-func (o *snapshotter) Close() error {
-	var err = o.ms.Close()
+func (o *snapshotter) Close() (err error) {
+	ctx, span := startSpan(context.Background(), "lvm.Close")
+	defer endSpan(span, &err)
+
+	o.stopWatch()
+	err = o.ms.Close()
 	if err != nil {
 		return err
 	}
-	err = unmountVolume(o.config.VgName, metavolume)
+	err = unmountVolume(ctx, o.config.VgName, metavolume)
 	if err != nil {
 		return err
 	}
-	_, err = toggleactivateLV(o.config.VgName, metavolume, false)
+	_, err = toggleactivateLV(ctx, o.config.VgName, metavolume, false)
 	if err != nil {
 		return err
 	}
@@ -25,8 +25,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/pkg/testutil"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
 	"github.com/containerd/continuity/testutil/loopback"
 	"gotest.tools/assert"
@@ -60,13 +63,13 @@ func TestLVMSnapshotterSuite(t *testing.T) {
 		vgName = vgNamePrefix + suffix
 		lvPool = lvPoolPrefix + suffix
 
-		output, err := createVolumeGroup(loopDevice.Device, vgName)
+		output, err := createVolumeGroup(ctx, loopDevice.Device, vgName)
 		assert.NilError(t, err, output)
 
-		output, err = toggleactivateVG(vgName, true)
+		output, err = toggleactivateVG(ctx, vgName, true)
 		assert.NilError(t, err, output)
 
-		output, err = createLogicalThinPool(vgName, lvPool)
+		output, err = createLogicalThinPool(ctx, vgName, lvPool, ThinPoolOptions{})
 		assert.NilError(t, err, output)
 
 		config := &SnapConfig{
@@ -81,7 +84,7 @@ func TestLVMSnapshotterSuite(t *testing.T) {
 
 		return snap, func() error {
 			snap.Close()
-			deleteVolumeGroup(vgName)
+			deleteVolumeGroup(ctx, vgName)
 			loopDevice.Close()
 			return nil
 		}, nil
@@ -90,3 +93,54 @@ func TestLVMSnapshotterSuite(t *testing.T) {
 	testsuite.SnapshotterSuite(t, "LVM", testLvmSnapshotter)
 
 }
+
+func TestBlockModeRequested(t *testing.T) {
+	block, err := blockModeRequested("", nil)
+	assert.NilError(t, err)
+	assert.Assert(t, !block)
+
+	block, err = blockModeRequested(MountModeBlock, map[string]string{})
+	assert.NilError(t, err)
+	assert.Assert(t, block)
+
+	block, err = blockModeRequested(MountModeBlock, map[string]string{LabelMountMode: MountModeFilesystem})
+	assert.NilError(t, err)
+	assert.Assert(t, !block)
+
+	block, err = blockModeRequested(MountModeFilesystem, map[string]string{LabelMountMode: MountModeBlock})
+	assert.NilError(t, err)
+	assert.Assert(t, block)
+
+	_, err = blockModeRequested("", map[string]string{LabelMountMode: "raw"})
+	assert.Assert(t, errdefs.IsInvalidArgument(err))
+}
+
+func TestMountOptions(t *testing.T) {
+	o := &snapshotter{config: &SnapConfig{FsType: "xfs"}}
+	vol := volume{VgName: "vg"}
+
+	m := o.mounts(storage.Snapshot{ID: "1", Kind: snapshots.KindActive}, vol)
+	assert.DeepEqual(t, m, []mount.Mount{{Source: "/dev/vg/1", Type: "xfs", Options: []string{"nouuid"}}})
+
+	o.config.Discard.Mount = true
+	m = o.mounts(storage.Snapshot{ID: "1", Kind: snapshots.KindActive}, vol)
+	assert.DeepEqual(t, m[0].Options, []string{"discard", "nouuid"})
+
+	m = o.mounts(storage.Snapshot{ID: "2", Kind: snapshots.KindView}, vol)
+	assert.DeepEqual(t, m[0].Options, []string{"ro", "nouuid"})
+
+	o.config.FsType = "ext4"
+	vol.Encrypted = true
+	m = o.mounts(storage.Snapshot{ID: "3", Kind: snapshots.KindActive}, vol)
+	assert.DeepEqual(t, m, []mount.Mount{{Source: "/dev/mapper/vg-3-crypt", Type: "ext4", Options: []string{"discard"}}})
+
+	// Block volumes only differ in being left unmounted, the type carries
+	// the filesystem and host mounts take the options as they are
+	vol.Block = true
+	m = o.mounts(storage.Snapshot{ID: "3", Kind: snapshots.KindActive}, vol)
+	assert.DeepEqual(t, m, []mount.Mount{{Source: "/dev/mapper/vg-3-crypt", Type: "ext4", Options: []string{"discard"}}})
+
+	o.config.FsType = "xfs"
+	m = o.mounts(storage.Snapshot{ID: "4", Kind: snapshots.KindView}, volume{VgName: "vg", Block: true})
+	assert.DeepEqual(t, m, []mount.Mount{{Source: "/dev/vg/4", Type: "xfs", Options: []string{"ro", "nouuid"}}})
+}
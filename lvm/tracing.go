@@ -0,0 +1,115 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer the spans of the snapshotter are
+// created with. Spans go to the global tracer provider, which records nothing
+// unless the process configured one.
+const TracerName = "github.com/ganeshmaharaj/lvm-snapshotter"
+
+// startSpan starts a child span of the one in the context, tagged with the
+// containerd namespace of the call
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		attrs = append(attrs, attribute.String("containerd.namespace", ns))
+	}
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, marking it as failed when the operation returned an
+// error. It is deferred with a pointer to the named error of the operation.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// tracedTx ends the span of a metadata transaction once it is committed or
+// rolled back
+type tracedTx struct {
+	storage.Transactor
+	span trace.Span
+}
+
+func (t *tracedTx) Commit() error {
+	err := t.Transactor.Commit()
+	endSpan(t.span, &err)
+	return err
+}
+
+func (t *tracedTx) Rollback() error {
+	err := t.Transactor.Rollback()
+	t.span.End()
+	return err
+}
+
+// transaction starts a metadata transaction with its own span, so the time
+// spent holding the write lock of the metadata store shows in traces
+func (o *snapshotter) transaction(ctx context.Context, writable bool) (context.Context, storage.Transactor, error) {
+	ctx, span := startSpan(ctx, "metastore.transaction", attribute.Bool("writable", writable))
+	ctx, t, err := o.ms.TransactionContext(ctx, writable)
+	if err != nil {
+		endSpan(span, &err)
+		return ctx, nil, err
+	}
+	return ctx, &tracedTx{Transactor: t, span: span}, nil
+}
+
+// tempMount mounts the volume for the duration of f. Tests replace it to run
+// without mounting.
+var tempMount = mount.WithTempMount
+
+// withTempMount mounts the volume for the duration of f under a span
+func withTempMount(ctx context.Context, mounts []mount.Mount, f func(root string) error) (err error) {
+	ctx, span := startSpan(ctx, "mount", mountAttributes(mounts)...)
+	defer endSpan(span, &err)
+	return tempMount(ctx, mounts, f)
+}
+
+// mountAll mounts the volume on target under a span
+func mountAll(ctx context.Context, mounts []mount.Mount, target string) (err error) {
+	_, span := startSpan(ctx, "mount", append(mountAttributes(mounts), attribute.String("mount.target", target))...)
+	defer endSpan(span, &err)
+	return mount.All(mounts, target)
+}
+
+func mountAttributes(mounts []mount.Mount) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for _, m := range mounts {
+		attrs = append(attrs,
+			attribute.String("mount.source", m.Source),
+			attribute.String("mount.type", m.Type),
+			attribute.Array("mount.options", m.Options))
+	}
+	return attrs
+}
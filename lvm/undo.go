@@ -0,0 +1,59 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/log"
+)
+
+// undoStack collects the actions compensating the steps an operation took so
+// far. They run in reverse order when the operation fails, leaving neither
+// devices nor records behind.
+type undoStack struct {
+	actions []undoAction
+}
+
+type undoAction struct {
+	what string
+	do   func(ctx context.Context) error
+}
+
+// push registers the action undoing a step that succeeded
+func (u *undoStack) push(what string, do func(ctx context.Context) error) {
+	u.actions = append(u.actions, undoAction{what: what, do: do})
+}
+
+// run undoes the steps in reverse order and reports whether all of them were
+// undone. It goes on after failures, which are logged and leave the rest to
+// the recovery of the intent log.
+func (u *undoStack) run(ctx context.Context) bool {
+	undone := true
+	for i := len(u.actions) - 1; i >= 0; i-- {
+		a := u.actions[i]
+		log.G(ctx).Debugf("Undoing: %s", a.what)
+		if err := a.do(ctx); err != nil {
+			log.G(ctx).WithError(err).Warnf("Unable to undo: %s", a.what)
+			undone = false
+		}
+	}
+	u.actions = nil
+	return undone
+}
@@ -0,0 +1,191 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+)
+
+func TestPrepareUndo(t *testing.T) {
+	none := func(context.Context, *snapshotter) error { return nil }
+	for _, step := range steps(t, none, prepare("active")) {
+		withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+			f.fail = step
+			_, err := o.Prepare(ctx, "active", "")
+			assert.ErrorContains(t, err, "", step)
+			f.fail = ""
+
+			_, err = o.Stat(ctx, "active")
+			assert.Assert(t, errdefs.IsNotFound(err), step)
+			_, err = o.keys.get("1")
+			assert.ErrorContains(t, err, "Unable to read key 1", step)
+			assertConsistent(ctx, t, o, f, step)
+		})
+	}
+}
+
+func TestCloneUndo(t *testing.T) {
+	clone := func(ctx context.Context, o *snapshotter) error {
+		_, err := o.Clone(ctx, "clone", "active")
+		return err
+	}
+	for _, step := range steps(t, prepare("active"), clone) {
+		withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+			assert.NilError(t, prepare("active")(ctx, o))
+			f.fail = step
+			assert.ErrorContains(t, clone(ctx, o), "", step)
+			f.fail = ""
+
+			_, err := o.Stat(ctx, "clone")
+			assert.Assert(t, errdefs.IsNotFound(err), step)
+			assertConsistent(ctx, t, o, f, step)
+		})
+	}
+}
+
+func TestUndoStackRun(t *testing.T) {
+	var (
+		undo undoStack
+		ran  []string
+	)
+	for _, what := range []string{"first", "second", "third"} {
+		what := what
+		undo.push(what, func(ctx context.Context) error {
+			ran = append(ran, what)
+			if what == "second" {
+				return errors.New("injected failure")
+			}
+			return nil
+		})
+	}
+	assert.Assert(t, !undo.run(context.Background()))
+	assert.DeepEqual(t, ran, []string{"third", "second", "first"})
+	assert.Assert(t, undo.run(context.Background()))
+}
+
+func TestCommitUndo(t *testing.T) {
+	for _, step := range steps(t, prepare("active"), commit("committed", "active")) {
+		withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+			assert.NilError(t, prepare("active")(ctx, o))
+			f.fail = step
+			assert.ErrorContains(t, commit("committed", "active")(ctx, o), "", step)
+			f.fail = ""
+
+			// What could not be undone is left to the recovery
+			assert.NilError(t, o.recoverIntents(ctx))
+			_, err := o.Stat(ctx, "committed")
+			assert.Assert(t, errdefs.IsNotFound(err), step)
+			assertActive(ctx, t, o, "active", step)
+			assertConsistent(ctx, t, o, f, step)
+		})
+	}
+}
+
+func TestCheckpointUndo(t *testing.T) {
+	checkpoint := func(ctx context.Context, o *snapshotter) error {
+		return o.Checkpoint(ctx, "checkpoint", "active")
+	}
+	for _, step := range steps(t, prepare("active"), checkpoint) {
+		withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+			assert.NilError(t, prepare("active")(ctx, o))
+			f.fail = step
+			assert.ErrorContains(t, checkpoint(ctx, o), "", step)
+			f.fail = ""
+
+			// What could not be undone is left to the recovery
+			assert.NilError(t, o.recoverIntents(ctx))
+			_, err := o.Stat(ctx, "checkpoint")
+			assert.Assert(t, errdefs.IsNotFound(err), step)
+			assertActive(ctx, t, o, "active", step)
+			assertConsistent(ctx, t, o, f, step)
+		})
+	}
+}
+
+func TestResetUndo(t *testing.T) {
+	reset := func(ctx context.Context, o *snapshotter) error {
+		_, err := o.Reset(ctx, "active")
+		return err
+	}
+	for _, step := range steps(t, prepare("active"), reset) {
+		withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+			assert.NilError(t, prepare("active")(ctx, o))
+			f.fail = step
+			err := reset(ctx, o)
+			f.fail = ""
+
+			// Resets failing once the volume is deleted, or whose
+			// steps could not be undone, are recovered from the intent
+			// log. The fake fails renames of missing volumes only.
+			assert.ErrorContains(t, err, "", step)
+			assert.NilError(t, o.recoverIntents(ctx))
+			assertActive(ctx, t, o, "active", step)
+			assertConsistent(ctx, t, o, f, step)
+		})
+	}
+}
+
+func TestFinalCommitUndo(t *testing.T) {
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		assert.NilError(t, prepare("active")(ctx, o))
+		assert.NilError(t, prepare("other")(ctx, o))
+		assert.NilError(t, commit("committed", "other")(ctx, o))
+
+		// The volumes are complete when the metadata refuses the name
+		err := commit("committed", "active")(ctx, o)
+		assert.Assert(t, errdefs.IsAlreadyExists(err), err)
+		assertActive(ctx, t, o, "active", "commit")
+		assertConsistent(ctx, t, o, f, "commit")
+
+		err = o.Checkpoint(ctx, "committed", "active")
+		assert.Assert(t, errdefs.IsAlreadyExists(err), err)
+		assertActive(ctx, t, o, "active", "checkpoint")
+		assertConsistent(ctx, t, o, f, "checkpoint")
+	})
+}
+
+func TestFailedUndoKeepsIntent(t *testing.T) {
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		assert.NilError(t, prepare("active")(ctx, o))
+		assert.NilError(t, prepare("other")(ctx, o))
+		assert.NilError(t, commit("committed", "other")(ctx, o))
+
+		// Reactivating the volume fails along with the commit
+		f.fail = "lvchange -K vg/1 -a y"
+		err := commit("committed", "active")(ctx, o)
+		assert.Assert(t, errdefs.IsAlreadyExists(err), err)
+		f.fail = ""
+		var pending map[string]intent
+		assert.NilError(t, o.withTransaction(ctx, false, func(ctx context.Context, tx storage.Transactor) (err error) {
+			pending, err = intents(tx)
+			return err
+		}))
+		assert.Equal(t, pending["1"].Op, intentCommit)
+
+		assert.NilError(t, o.recoverIntents(ctx))
+		assertActive(ctx, t, o, "active", "recovery")
+		assertConsistent(ctx, t, o, f, "recovery")
+	})
+}
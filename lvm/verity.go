@@ -0,0 +1,112 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LabelVerityRootHash holds the dm-verity root hash of a committed
+	// snapshot protected by a hash tree
+	LabelVerityRootHash = "containerd.io/snapshot/lvm.verity.roothash"
+
+	// Hash trees take a little less than 1% of the data with 4k blocks and
+	// sha256, leave room for the upper levels of the tree.
+	verityHashRatio   = 64
+	verityMinHashSize = 8 << 20
+)
+
+var rootHashRe = regexp.MustCompile(`(?m)^Root hash:\s+([0-9a-fA-F]+)\s*$`)
+
+// hashLVName returns the name of the companion volume holding the hash tree
+func hashLVName(lvname string) string {
+	return lvname + "-verity"
+}
+
+func verityName(vgname string, lvname string) string {
+	return vgname + "-" + lvname + "-verity"
+}
+
+func verityDevice(vgname string, lvname string) string {
+	return filepath.Join("/dev/mapper", verityName(vgname, lvname))
+}
+
+// verityHashSize returns the virtual size of the hash volume for a data
+// volume of the given size
+func verityHashSize(dataSize uint64) string {
+	size := dataSize / verityHashRatio
+	if size < verityMinHashSize {
+		size = verityMinHashSize
+	}
+	return fmt.Sprintf("%db", size)
+}
+
+func parseRootHash(output string) (string, error) {
+	m := rootHashRe.FindStringSubmatch(output)
+	if m == nil {
+		return "", errors.Errorf("no root hash in veritysetup output: %q", output)
+	}
+	return m[1], nil
+}
+
+// verityFormat builds the hash tree of the data device into the hash device
+// and returns the root hash
+func verityFormat(ctx context.Context, dataDevice string, hashDevice string) (string, error) {
+	cmd := "veritysetup"
+	args := []string{"format", dataDevice, hashDevice}
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil {
+		return "", errors.Wrapf(err, "veritysetup format failed: %s", output)
+	}
+	return parseRootHash(output)
+}
+
+// verityVerify checks the whole data device against the hash tree
+func verityVerify(ctx context.Context, dataDevice string, hashDevice string, rootHash string) error {
+	cmd := "veritysetup"
+	args := []string{"verify", dataDevice, hashDevice, rootHash}
+	if output, err := runCommandOnce(ctx, cmd, args); err != nil {
+		return errors.Wrapf(err, "verification of %s failed: %s", dataDevice, output)
+	}
+	return nil
+}
+
+func verityOpen(ctx context.Context, dataDevice string, name string, hashDevice string, rootHash string) (string, error) {
+	cmd := "veritysetup"
+	args := []string{"open", dataDevice, name, hashDevice, rootHash}
+	return runCommand(ctx, cmd, args)
+}
+
+func verityClose(ctx context.Context, name string) (string, error) {
+	cmd := "veritysetup"
+	args := []string{"close", name}
+	var re = regexp.MustCompile(`not active|doesn't exist`)
+
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil && re.MatchString(output) {
+		return output, nil
+	}
+	return output, err
+}
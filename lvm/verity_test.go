@@ -0,0 +1,84 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseRootHash(t *testing.T) {
+	output := `VERITY header information for /dev/vgthin/1-verity
+UUID:            	9c2b0d5e-1b4a-4a8c-9d36-2d1e0f6b1a77
+Hash type:       	1
+Data blocks:     	2621440
+Data block size: 	4096
+Hash block size: 	4096
+Hash algorithm:  	sha256
+Salt:            	5d3b4b7bd7a2c4f7d0f1b3c2a1e9f8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1
+Root hash:      	4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076`
+
+	hash, err := parseRootHash(output)
+	assert.NilError(t, err)
+	assert.Equal(t, hash, "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076")
+
+	_, err = parseRootHash("Device /dev/vgthin/1 is too small.")
+	assert.ErrorContains(t, err, "no root hash")
+}
+
+func TestVerityHashSize(t *testing.T) {
+	assert.Equal(t, verityHashSize(64<<20), "8388608b")
+	assert.Equal(t, verityHashSize(10<<30), "167772160b")
+}
+
+func TestVerifyOncePerActivation(t *testing.T) {
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		o.config.Verity = true
+		assert.NilError(t, prepare("active")(ctx, o))
+		assert.NilError(t, commit("base", "active")(ctx, o))
+
+		verifications := func() int {
+			n := 0
+			for _, call := range f.calls {
+				if strings.HasPrefix(call, "veritysetup verify ") {
+					n++
+				}
+			}
+			return n
+		}
+		f.calls = nil
+		for _, key := range []string{"child1", "child2"} {
+			_, err := o.Prepare(ctx, key, "base")
+			assert.NilError(t, err)
+		}
+		assert.Equal(t, verifications(), 1, f.calls)
+
+		// The last view of the parent deactivates it, the next child
+		// verifies it again
+		_, err := o.View(ctx, "view", "base")
+		assert.NilError(t, err)
+		assert.NilError(t, o.Remove(ctx, "view"))
+		_, err = o.Prepare(ctx, "child3", "base")
+		assert.NilError(t, err)
+		assert.Equal(t, verifications(), 2, f.calls)
+	})
+}
@@ -0,0 +1,166 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+// overwriteMu runs overwrites one at a time. An overwrite provisions every
+// block of the thin volume until it is discarded, overwrites running side by
+// side would add up in the pool.
+var overwriteMu sync.Mutex
+
+// poolZeroes tells whether the thin pool zeroes the blocks it provisions, so
+// that unmapped blocks never show data of the volumes they belonged to
+func poolZeroes(ctx context.Context, vgname string, lvpoolname string) (bool, error) {
+	cmd := "lvs"
+	args := []string{vgname + "/" + lvpoolname, "--options", "zero", "--noheadings"}
+	output, err := runCommand(ctx, cmd, args)
+	if err != nil {
+		return false, errors.Wrapf(err, "Unable to query pool %s/%s: %s", vgname, lvpoolname, output)
+	}
+	return strings.TrimSpace(output) == "zero", nil
+}
+
+func overwriteDevice(ctx context.Context, device string) (string, error) {
+	cmd := "shred"
+	args := []string{"--iterations=1", "--zero", "--force", device}
+	return runCommand(ctx, cmd, args)
+}
+
+func eraseCrypt(ctx context.Context, vgname string, lvname string) (string, error) {
+	cmd := "cryptsetup"
+	args := []string{"erase", "--batch-mode", filepath.Join("/dev", vgname, lvname)}
+	return runCommand(ctx, cmd, args)
+}
+
+// wipeVolume destroys the contents of a volume that is about to be removed
+// according to the wipe policy and logs an audit record once it is done.
+//
+// Writing zeroes over a thin volume would provision all of its blocks, so
+// zeroing discards its blocks instead and relies on the pool zeroing the
+// blocks it provisions. Overwrites do provision the whole volume, they only
+// run when the pool has room for it and discard the volume afterwards.
+func (o *snapshotter) wipeVolume(ctx context.Context, key string, vol volume, id string) error {
+	policy := o.config.WipePolicy
+	if policy == WipeCryptoErase {
+		// The key of a thin snapshot is the key of its parents, siblings
+		// and children, whose LUKS headers hold copies of it. Erasing the
+		// header of one of them leaves the data readable through another.
+		shared := false
+		if vol.Encrypted {
+			if err := o.withTransaction(ctx, false, func(ctx context.Context, t storage.Transactor) (err error) {
+				shared, err = keyShared(t, vol.KeyID, id)
+				return err
+			}); err != nil {
+				return err
+			}
+		}
+		if !vol.Encrypted || shared {
+			// Nothing to erase the key of, zero the volume instead
+			policy = WipeZero
+		}
+	}
+
+	if _, err := toggleactivateLV(ctx, vol.VgName, id, true); err != nil {
+		return errors.Wrap(err, "Unable to activate volume")
+	}
+
+	start := time.Now()
+	device := filepath.Join("/dev", vol.VgName, id)
+	var (
+		out string
+		err error
+	)
+	switch policy {
+	case WipeZero:
+		var zeroes bool
+		if zeroes, err = poolZeroes(ctx, vol.VgName, vol.ThinPool); err != nil {
+			return err
+		}
+		if !zeroes {
+			return errors.Wrapf(errdefs.ErrFailedPrecondition, "pool %s/%s does not zero new blocks", vol.VgName, vol.ThinPool)
+		}
+		out, err = discardDevice(ctx, device)
+	case WipeOverwrite:
+		out, err = o.overwriteVolume(ctx, vol, id)
+	case WipeCryptoErase:
+		// The crypt mapping has to be gone before the keyslots are erased
+		if out, err = closeCrypt(ctx, vol.VgName, id); err == nil {
+			out, err = eraseCrypt(ctx, vol.VgName, id)
+		}
+	default:
+		return errors.Errorf("unknown wipe policy %q", policy)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to wipe volume with policy %s: %s", policy, out)
+	}
+
+	ns, _ := namespaces.Namespace(ctx)
+	log.G(ctx).
+		WithField("audit", "wipe").
+		WithField("key", key).
+		WithField("namespace", ns).
+		WithField("id", id).
+		WithField("pool", vol.Pool).
+		WithField("policy", policy).
+		WithField("duration", time.Since(start)).
+		Info("Volume wiped")
+	return nil
+}
+
+// overwriteVolume overwrites the whole thin volume and discards it, which
+// returns the blocks it provisioned to the pool
+func (o *snapshotter) overwriteVolume(ctx context.Context, vol volume, id string) (string, error) {
+	overwriteMu.Lock()
+	defer overwriteMu.Unlock()
+
+	size, err := lvSize(ctx, vol.VgName, id)
+	if err != nil {
+		return "", err
+	}
+	mapped, err := lvUsedSpace(ctx, vol.VgName, id)
+	if err != nil {
+		return "", err
+	}
+	free, err := poolFreeSpace(ctx, vol.VgName, vol.ThinPool)
+	if err != nil {
+		return "", err
+	}
+	if size-uint64(mapped) >= free {
+		return "", errors.Wrapf(errdefs.ErrFailedPrecondition, "pool %s/%s has %d bytes free, overwriting volume %s takes %d", vol.VgName, vol.ThinPool, free, id, size-uint64(mapped))
+	}
+
+	device := filepath.Join("/dev", vol.VgName, id)
+	if out, err := overwriteDevice(ctx, device); err != nil {
+		return out, err
+	}
+	return discardDevice(ctx, device)
+}
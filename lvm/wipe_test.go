@@ -0,0 +1,47 @@
+// +build linux
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package lvm
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestWipeSharedKey(t *testing.T) {
+	withFakeLVM(t, func(ctx context.Context, o *snapshotter, f *fakeLVM) {
+		o.config.WipePolicy = WipeCryptoErase
+		assert.NilError(t, prepare("active")(ctx, o))
+		assert.NilError(t, commit("base", "active")(ctx, o))
+		_, err := o.Prepare(ctx, "child", "base")
+		assert.NilError(t, err)
+
+		// The child shares the key of its parent, it is zeroed
+		f.calls = nil
+		assert.NilError(t, o.Remove(ctx, "child"))
+		assert.Assert(t, contains(f.calls, "blkdiscard /dev/vg/2"), f.calls)
+		assert.Assert(t, !contains(f.calls, "cryptsetup erase --batch-mode /dev/vg/2"), f.calls)
+
+		f.calls = nil
+		assert.NilError(t, o.Remove(ctx, "base"))
+		assert.Assert(t, contains(f.calls, "cryptsetup erase --batch-mode /dev/vg/1"), f.calls)
+		assertConsistent(ctx, t, o, f, "remove")
+	})
+}
@@ -7,13 +7,18 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
 	"github.com/containerd/containerd/contrib/snapshotservice"
+	"github.com/containerd/containerd/log"
+	lvmapi "github.com/ganeshmaharaj/lvm-snapshotter/api/services/lvm/v1"
 	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
 )
 
@@ -21,39 +26,56 @@ var usage = `an image layering tool using the containerd shapshots
 	 API and the thin logical volume device mapper of LVM.
 
 	 To run lvm-snapshotter a path to the unix socket address, volume group name,
-	 and logical volume pool name are required:
+	 and logical volume pool name are required, either in a configuration file
+	 or as flags, which take precedence:
 
 	 $ lvm-snapshotter --addr /path/to/socket --vgname volumegroup --lvpoolname poolname
+	 $ lvm-snapshotter --config /etc/lvm-snapshotter/config.toml
+
+	 The commands inspect and repair a stopped instance with the same flags:
+
+	 $ lvm-snapshotter --vgname volumegroup --lvpoolname poolname ls
 `
 
 const lvmSnapshotterVersion string = "0.0.1"
 
-func prepareSnapshotter(addr, vgname, lvpoolname string) error {
-	// Create a gRPC server
-	rpc := grpc.NewServer()
+// snapshotsServiceName is the name of containerd's snapshots service in the
+// health service
+const snapshotsServiceName = "containerd.services.snapshots.v1.Snapshots"
 
-	// Configure your custom snapshotter, this example uses the native
-	// snapshotter and a root directory. Your custom snapshotter will be
-	// much more useful than using a snapshotter which is already included.
-	// https://godoc.org/github.com/containerd/containerd/snapshots#Snapshotter
-	config := &lvms.SnapConfig{
-		VgName:   vgname,
-		ThinPool: lvpoolname,
-	}
-	if err := config.Validate(""); err != nil {
-		return errors.Wrap(err, "Failed to validate config")
+func prepareSnapshotter(config *daemonConfig) error {
+	if config.Address == "" {
+		return errors.New("incorrect usage, the socket address is required, view help for correct argument usage")
 	}
-	ctx := context.Background()
-	sn, err := lvms.NewSnapshotter(ctx, config)
+	config.setupLogging()
+	interval, _ := time.ParseDuration(config.HealthInterval)
+
+	shutdownTracing, err := setupTracing(config.Tracing)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		if closeErr := sn.Close(); closeErr != nil {
-			fmt.Printf("error: %v\n", closeErr)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.L.WithError(err).Error("Unable to flush traces")
 		}
 	}()
 
+	// Create a gRPC server. It serves health checks while the snapshotter
+	// is initialized and reconciled, other calls are rejected until then.
+	gate := &readyGate{}
+	rpc := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(traceUnary, gate.intercept),
+		grpc.ChainStreamInterceptor(traceStream, gate.stream),
+	)
+
+	// Configure your custom snapshotter, this example uses the native
+	// snapshotter and a root directory. Your custom snapshotter will be
+	// much more useful than using a snapshotter which is already included.
+	// https://godoc.org/github.com/containerd/containerd/snapshots#Snapshotter
+	sn := &lazySnapshotter{}
+
 	// Convert the snapshotter to a gRPC service,
 	// example in github.com/containerd/containerd/contrib/snapshotservice
 	service := snapshotservice.FromSnapshotter(sn)
@@ -61,60 +83,114 @@ func prepareSnapshotter(addr, vgname, lvpoolname string) error {
 	// Register the service with the gRPC server
 	snapshotsapi.RegisterSnapshotsServer(rpc, service)
 
-	var gracefulstop = make(chan os.Signal)
+	// Operations beyond the snapshots API are served next to it
+	lvmapi.RegisterLVMServer(rpc, lvms.FromSnapshotter(sn))
+
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(rpc, healthServer)
+	reporter := newHealthReporter(healthServer, gate, snapshotsServiceName, lvmapi.ServiceName)
+
+	addr := config.Address
+	var gracefulstop = make(chan os.Signal, 1)
 	signal.Notify(gracefulstop, syscall.SIGTERM)
 	signal.Notify(gracefulstop, syscall.SIGINT)
 	go func() {
 		<-gracefulstop
-		rpc.GracefulStop()
+		gracefulStop(rpc, healthServer, gate, sn)
 		if rmErr := os.Remove(addr); rmErr != nil {
-			fmt.Printf("error: unable to remove %s: %v\n", addr, rmErr)
+			log.L.WithError(rmErr).Errorf("Unable to remove %s", addr)
 		}
 	}()
 
+	// Listen on the metrics address first, which leaves nothing to clean
+	// up when it is taken
+	var ml net.Listener
+	if config.MetricsAddress != "" {
+		if ml, err = net.Listen("tcp", config.MetricsAddress); err != nil {
+			return errors.Wrap(err, "Unable to listen for metrics")
+		}
+		defer ml.Close()
+	}
+
 	// Listen and serve
 	l, err := net.Listen("unix", addr)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Ready and listening on socket %s...", addr)
-	if err := rpc.Serve(l); err != nil {
+	mode, _ := config.socketMode()
+	if err := os.Chmod(addr, mode); err != nil {
+		l.Close()
+		os.Remove(addr)
+		return errors.Wrapf(err, "Unable to set permissions of %s", addr)
+	}
+	if gid, _ := config.socketGID(); gid >= 0 {
+		if err := os.Chown(addr, -1, gid); err != nil {
+			l.Close()
+			os.Remove(addr)
+			return errors.Wrapf(err, "Unable to set group of %s", addr)
+		}
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- rpc.Serve(l)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapshotter, err := lvms.NewSnapshotter(ctx, &config.Snapshotter)
+	if err != nil {
+		rpc.Stop()
+		os.Remove(addr)
 		return err
 	}
-	return nil
+	defer func() {
+		if closeErr := snapshotter.Close(); closeErr != nil {
+			log.L.WithError(closeErr).Error("Unable to close the snapshotter")
+		}
+	}()
+	sn.Snapshotter = snapshotter
+
+	if ml != nil {
+		msrv, err := serveMetrics(ml, snapshotter)
+		if err != nil {
+			rpc.Stop()
+			os.Remove(addr)
+			return errors.Wrap(err, "Unable to serve metrics")
+		}
+		defer msrv.Close()
+	}
+
+	go reporter.run(ctx, snapshotter, interval)
+
+	log.L.WithField("address", addr).Info("Ready and listening")
+	return <-served
 }
 
-func createApp() error {
-	var addr string
-	var vgname string
-	var lvpoolname string
+// gracefulStop waits for the calls in progress before stopping the server.
+// Event subscriptions only end with their clients, they are ended first.
+func gracefulStop(rpc *grpc.Server, healthServer *health.Server, gate *readyGate, sn lvms.Snapshotter) {
+	healthServer.Shutdown()
+	// Subscriptions are only possible once the gate opened, which happens
+	// after the snapshotter was initialized
+	if gate.close() {
+		sn.CloseEvents()
+	}
+	rpc.GracefulStop()
+}
 
+func createApp() error {
 	app := cli.NewApp()
 	app.Name = "lvmsnapshotter"
 	app.Usage = usage
 	app.Version = lvmSnapshotterVersion
-	app.Flags = []cli.Flag{
-		cli.StringFlag{
-			Name:        "addr",
-			Usage:       "the socket the snapshotter will listen on, it is the 'address' in the containerd 'proxy plugin' configuration.",
-			Destination: &addr,
-		},
-		cli.StringFlag{
-			Name:        "vgname",
-			Usage:       "name of created volume group",
-			Destination: &vgname,
-		},
-		cli.StringFlag{
-			Name:        "lvpoolname",
-			Usage:       "name of logical volume pool",
-			Destination: &lvpoolname,
-		},
-	}
+	app.Flags = configFlags
+	app.Commands = adminCommands
 	app.Action = func(ctx *cli.Context) error {
-		if ctx.NumFlags() != 3 {
-			return fmt.Errorf("incorrect usage, view help for correct argument usage")
+		config, err := loadConfig(ctx)
+		if err != nil {
+			return err
 		}
-		return prepareSnapshotter(addr, vgname, lvpoolname)
+		return prepareSnapshotter(config)
 	}
 	return app.Run(os.Args)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"gotest.tools/assert"
+
+	lvmapi "github.com/ganeshmaharaj/lvm-snapshotter/api/services/lvm/v1"
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+// subscribedSnapshotter holds a single subscription until its events are
+// closed
+type subscribedSnapshotter struct {
+	lvms.Snapshotter
+	subscribed chan struct{}
+	events     chan lvms.Event
+	errs       chan error
+}
+
+func (s *subscribedSnapshotter) Subscribe(ctx context.Context, namespaces ...string) (<-chan lvms.Event, <-chan error) {
+	close(s.subscribed)
+	return s.events, s.errs
+}
+
+func (s *subscribedSnapshotter) CloseEvents() {
+	s.errs <- errors.Wrap(errdefs.ErrUnavailable, "snapshotter is shutting down")
+	close(s.events)
+}
+
+func TestGracefulStopEndsSubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lvm-stop-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "lvm.sock")
+	l, err := net.Listen("unix", addr)
+	assert.NilError(t, err)
+
+	sn := &subscribedSnapshotter{
+		subscribed: make(chan struct{}),
+		events:     make(chan lvms.Event),
+		errs:       make(chan error, 1),
+	}
+	gate := &readyGate{}
+	gate.open()
+	rpc := grpc.NewServer(grpc.ChainStreamInterceptor(gate.stream))
+	lvmapi.RegisterLVMServer(rpc, lvms.FromSnapshotter(sn))
+	served := make(chan error, 1)
+	go func() {
+		served <- rpc.Serve(l)
+	}()
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+	}))
+	assert.NilError(t, err)
+	defer conn.Close()
+	stream, err := lvmapi.NewLVMClient(conn).Subscribe(context.Background(), &lvmapi.SubscribeRequest{})
+	assert.NilError(t, err)
+	<-sn.subscribed
+
+	stopped := make(chan struct{})
+	go func() {
+		gracefulStop(rpc, health.NewServer(), gate, sn)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		rpc.Stop()
+		t.Fatal("graceful stop waited for the subscription")
+	}
+	assert.NilError(t, <-served)
+
+	_, err = stream.Recv()
+	assert.Assert(t, errdefs.IsUnavailable(errdefs.FromGRPC(err)))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+// serveMetrics serves the metrics of the snapshotter on /metrics of the
+// listener until the returned server is closed
+func serveMetrics(l net.Listener, sn lvms.Snapshotter) (*http.Server, error) {
+	reg := prometheus.NewRegistry()
+	if err := lvms.RegisterMetrics(reg, sn); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	return srv, nil
+}
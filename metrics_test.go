@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+func TestServeMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	srv, err := serveMetrics(l, nil)
+	assert.NilError(t, err)
+	defer srv.Close()
+
+	// The volume group does not exist, which fails the first LVM command
+	_, err = lvms.NewSnapshotter(context.Background(), &lvms.SnapConfig{VgName: "vg-metrics-test", ThinPool: "pool"})
+	assert.Assert(t, err != nil)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Contains(string(body), `lvm_snapshotter_command_duration_seconds_count{command="vgs",status="error"} 1`))
+	assert.Assert(t, is.Contains(string(body), `lvm_snapshotter_command_retries_total{command="vgs"} 9`))
+}
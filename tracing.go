@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+const (
+	traceExporterOTLP = "otlp"
+	traceExporterFile = "file"
+
+	defaultTraceEndpoint = "http://127.0.0.1:4318/v1/traces"
+)
+
+// tracingSettings configure where the spans of the daemon are exported
+type tracingSettings struct {
+	// Exporter is "otlp" to post spans to an OTLP/HTTP endpoint, "file" to
+	// append them to a local file, or empty to disable tracing
+	Exporter string `toml:"exporter"`
+
+	// Endpoint is the URL the otlp exporter posts spans to
+	Endpoint string `toml:"endpoint"`
+
+	// Path is the file the file exporter appends spans to
+	Path string `toml:"path"`
+}
+
+func (t *tracingSettings) validate() error {
+	switch t.Exporter {
+	case "":
+	case traceExporterOTLP:
+		if t.Endpoint == "" {
+			t.Endpoint = defaultTraceEndpoint
+		}
+		if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.Errorf("invalid tracing endpoint %q, expected a URL like %s", t.Endpoint, defaultTraceEndpoint)
+		}
+	case traceExporterFile:
+		if t.Path == "" {
+			return errors.New("tracing path is required by the file exporter")
+		}
+	default:
+		return errors.Errorf("invalid tracing exporter %q, expected %s or %s", t.Exporter, traceExporterOTLP, traceExporterFile)
+	}
+	return nil
+}
+
+// setupTracing installs the tracer provider the snapshotter creates its
+// spans with and the W3C trace context propagator. The returned function
+// flushes the remaining spans and stops exporting.
+func setupTracing(t tracingSettings) (func(context.Context) error, error) {
+	if t.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	if t.Exporter == traceExporterFile {
+		exporter, err = newFileExporter(t.Path)
+	} else {
+		exporter, err = newOTLPExporter(t.Endpoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		// Follow the sampling decision of containerd when it sent one
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			attribute.String("service.name", "lvm-snapshotter"),
+			attribute.String("service.version", lvmSnapshotterVersion),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// metadataCarrier reads and writes the trace context in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startServerSpan starts the span of an incoming call as a child of the span
+// of the client, when it sent its trace context along. The log lines of the
+// call are tagged with its method and trace ID, which find the spans of a
+// logged failure.
+func startServerSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	method = strings.TrimPrefix(method, "/")
+	ctx, span := otel.Tracer(lvms.TracerName).Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc")))
+
+	fields := logrus.Fields{"method": method}
+	if sc := span.SpanContext(); sc.IsSampled() {
+		fields["trace_id"] = sc.TraceID().String()
+	}
+	return log.WithLogger(ctx, log.G(ctx).WithFields(fields)), span
+}
+
+func endServerSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceUnary and traceStream trace the calls to every service but the health
+// service, which is polled too often to be of interest
+func traceUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := info.Server.(healthpb.HealthServer); ok {
+		return handler(ctx, req)
+	}
+	ctx, span := startServerSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	endServerSpan(span, err)
+	return resp, err
+}
+
+func traceStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, ok := srv.(healthpb.HealthServer); ok {
+		return handler(srv, ss)
+	}
+	ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+	err := handler(srv, &tracedStream{ServerStream: ss, ctx: ctx})
+	endServerSpan(span, err)
+	return err
+}
+
+// tracedStream hands the context holding the span of the call to the handler
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
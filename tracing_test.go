@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/assert"
+
+	lvms "github.com/ganeshmaharaj/lvm-snapshotter/lvm"
+)
+
+// collector receives OTLP/HTTP export requests like an OpenTelemetry
+// collector
+type collector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req coltracepb.ExportTraceServiceRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || proto.Unmarshal(body, &req) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ils := range rs.InstrumentationLibrarySpans {
+			c.spans = append(c.spans, ils.Spans...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+func (c *collector) span(t *testing.T, name string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("span %s not received in %v", name, c.spans)
+	return nil
+}
+
+func TestTraceOTLP(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	shutdown, err := setupTracing(tracingSettings{Exporter: traceExporterOTLP, Endpoint: srv.URL + "/v1/traces"})
+	assert.NilError(t, err)
+
+	// containerd sends the trace context of its span along with the call
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	md := metadata.Pairs("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	info := &grpc.UnaryServerInfo{FullMethod: "/" + snapshotsServiceName + "/Prepare"}
+	_, err = traceUnary(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		// The volume group does not exist, which fails the first LVM command
+		return lvms.NewSnapshotter(ctx, &lvms.SnapConfig{VgName: "vg-tracing-test", ThinPool: "pool"})
+	})
+	assert.Assert(t, err != nil)
+	assert.NilError(t, shutdown(context.Background()))
+
+	server := c.span(t, snapshotsServiceName+"/Prepare")
+	assert.Equal(t, hex.EncodeToString(server.TraceId), traceID)
+	assert.Equal(t, hex.EncodeToString(server.ParentSpanId), spanID)
+	assert.Equal(t, server.Status.Code, tracepb.Status_STATUS_CODE_ERROR)
+
+	vgs := c.span(t, "vgs")
+	assert.Equal(t, hex.EncodeToString(vgs.TraceId), traceID)
+	assert.DeepEqual(t, vgs.ParentSpanId, server.SpanId)
+	assert.Equal(t, vgs.Status.Code, tracepb.Status_STATUS_CODE_ERROR)
+	attrs := map[string]*commonpb.AnyValue{}
+	for _, kv := range vgs.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, attrs["command.retries"].GetIntValue(), int64(9))
+	assert.Equal(t, attrs["command.args"].GetArrayValue().Values[0].GetStringValue(), "vg-tracing-test")
+}
+
+func TestTraceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lvm-tracing-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traces.json")
+
+	exporter, err := newFileExporter(path)
+	assert.NilError(t, err)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := provider.Tracer(lvms.TracerName)
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+	child.End()
+	parent.End()
+	assert.NilError(t, provider.Shutdown(context.Background()))
+
+	f, err := os.Open(path)
+	assert.NilError(t, err)
+	defer f.Close()
+	// The fields read back from the span snapshots the exporter writes
+	type fileSpan struct {
+		Name        string
+		SpanContext struct{ TraceID, SpanID string }
+		Parent      struct{ TraceID, SpanID string }
+
+		InstrumentationLibrary struct{ Name string }
+	}
+	var spans []fileSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var batch []fileSpan
+		assert.NilError(t, json.Unmarshal(scanner.Bytes(), &batch))
+		spans = append(spans, batch...)
+	}
+	assert.Equal(t, len(spans), 2)
+	assert.Equal(t, spans[0].Name, "child")
+	assert.Equal(t, spans[0].InstrumentationLibrary.Name, lvms.TracerName)
+	assert.Equal(t, spans[0].Parent.SpanID, spans[1].SpanContext.SpanID)
+	assert.Equal(t, spans[0].SpanContext.TraceID, spans[1].SpanContext.TraceID)
+}